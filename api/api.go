@@ -5,4 +5,10 @@ import "github.com/microhod/randflix-api/storage"
 // API defines the api object
 type API struct {
 	Storage storage.Storage
+	// DailyNoRepeatDays is the number of days before a title of the day can be picked again
+	DailyNoRepeatDays int
+	// RequireIfMatch rejects updates and patches without an If-Match header, so that writes can't be lost
+	RequireIfMatch bool
+
+	daily dailyCache
 }
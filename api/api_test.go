@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+// newTestAPI creates an api backed by an empty MemStore
+func newTestAPI(t *testing.T) *API {
+	t.Helper()
+
+	s, err := (&storage.Config{}).NewMemStore()
+	if err != nil {
+		t.Fatalf("NewMemStore() error: %s", err)
+	}
+	return &API{Storage: s}
+}
+
+func addTestTitles(t *testing.T, a *API, titles ...*title.Title) {
+	t.Helper()
+
+	for _, tt := range titles {
+		if _, err := a.Storage.AddTitle(context.Background(), tt); err != nil {
+			t.Fatalf("AddTitle() error: %s", err)
+		}
+	}
+}
+
+// titleRequest sends a request to the title endpoint, as routed for the title with the id
+func titleRequest(a *API, method string, id string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/title/"+id, strings.NewReader(body))
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+
+	w := httptest.NewRecorder()
+	a.TitleHandler(w, req)
+	return w
+}
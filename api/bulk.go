@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	// bulkBatchSize is the number of lines sent to storage at once
+	bulkBatchSize = 1000
+	// maxBulkLineSize is the longest line (title) which can be imported
+	maxBulkLineSize = 1024 * 1024
+)
+
+// bulkReport is the response to a bulk import, with a result for every (non blank) line
+// if storage fails, the import stops: the lines being written get the status "unknown" (as some may have been written)
+// and Error says why, later lines aren't read so have no result
+type bulkReport struct {
+	Created int          `json:"created"`
+	Updated int          `json:"updated"`
+	Failed  int          `json:"failed"`
+	Unknown int          `json:"unknown"`
+	Error   string       `json:"error,omitempty"`
+	Results []bulkResult `json:"results"`
+}
+
+type bulkResult struct {
+	// Line is the (1 indexed) line number in the request body
+	Line     int    `json:"line"`
+	ID       string `json:"id,omitempty"`
+	Status   string `json:"status"`
+	Revision int    `json:"revision,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// bulkLine is a title parsed from a line of the request body
+type bulkLine struct {
+	number int
+	title  *title.Title
+}
+
+// BulkTitlesHandler imports titles from newline delimited JSON, one title per line
+// with ?mode=upsert (the default) existing titles are replaced, with ?mode=insert they fail
+func (a *API) BulkTitlesHandler(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	defer a.daily.clear()
+
+	var mode storage.BulkMode
+	switch m := req.URL.Query().Get("mode"); m {
+	case "", "upsert":
+		mode = storage.Upsert
+	case "insert":
+		mode = storage.InsertOnly
+	default:
+		http.Error(w, fmt.Sprintf("mode must be 'upsert' or 'insert', got: '%s'", m), http.StatusBadRequest)
+		return
+	}
+
+	if !hasContentType(req, ndjsonContentType) {
+		http.Error(w, fmt.Sprintf("content type must be %s", ndjsonContentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	report := &bulkReport{Results: []bulkResult{}}
+	batch := []bulkLine{}
+
+	scanner := bufio.NewScanner(req.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxBulkLineSize)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var t *title.Title
+		if err := json.Unmarshal([]byte(line), &t); err != nil || t == nil {
+			report.fail(number, "", fmt.Sprintf("could not parse line to title: %v", err))
+			continue
+		}
+		if t.ID == "" {
+			report.fail(number, "", "title has no id")
+			continue
+		}
+
+		batch = append(batch, bulkLine{number: number, title: t})
+		if len(batch) == bulkBatchSize {
+			if err := a.bulkUpsert(req, report, batch, mode); err != nil {
+				writeBulkReport(w, report.abort(batch, err), http.StatusInternalServerError)
+				return
+			}
+			batch = batch[:0]
+		}
+	}
+	// a line which can't be read stops the import, but the titles before it are still written
+	if err := scanner.Err(); err != nil {
+		report.fail(number+1, "", fmt.Sprintf("could not read line: %s", err))
+	}
+
+	if err := a.bulkUpsert(req, report, batch, mode); err != nil {
+		writeBulkReport(w, report.abort(batch, err), http.StatusInternalServerError)
+		return
+	}
+
+	writeBulkReport(w, report, http.StatusOK)
+}
+
+func writeBulkReport(w http.ResponseWriter, report *bulkReport, status int) {
+	// lines which failed to parse are reported before their batch is written
+	sort.SliceStable(report.Results, func(i, j int) bool { return report.Results[i].Line < report.Results[j].Line })
+
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("ERROR: could not serialise bulk report: %s", err)
+		http.Error(w, "could not serialise bulk report", http.StatusInternalServerError)
+		return
+	}
+
+	addDefaultResponseHeaders(w)
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(bytes))
+}
+
+// bulkUpsert writes a batch of titles to storage, adding the results to the report
+func (a *API) bulkUpsert(req *http.Request, report *bulkReport, batch []bulkLine, mode storage.BulkMode) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	titles := []*title.Title{}
+	for _, l := range batch {
+		titles = append(titles, l.title)
+	}
+
+	results, err := a.Storage.BulkUpsert(req.Context(), titles, mode)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range results {
+		line := batch[i]
+		switch {
+		case r.Err != nil:
+			report.fail(line.number, line.title.ID, r.Err.Error())
+		case r.Created:
+			report.Created++
+			report.Results = append(report.Results, bulkResult{Line: line.number, ID: r.Title.ID, Status: "created", Revision: r.Title.Revision})
+		default:
+			report.Updated++
+			report.Results = append(report.Results, bulkResult{Line: line.number, ID: r.Title.ID, Status: "updated", Revision: r.Title.Revision})
+		}
+	}
+
+	return nil
+}
+
+// abort reports that storage failed while writing the batch, so the import stopped
+func (r *bulkReport) abort(batch []bulkLine, err error) *bulkReport {
+	log.Printf("ERROR: failed to bulk import titles to storage: %s", err)
+
+	for _, l := range batch {
+		r.Unknown++
+		r.Results = append(r.Results, bulkResult{Line: l.number, ID: l.title.ID, Status: "unknown"})
+	}
+	r.Error = fmt.Sprintf("failed to bulk import titles to storage, so lines %d to %d may not have been written "+
+		"and later lines weren't read: %s", batch[0].number, batch[len(batch)-1].number, err)
+
+	return r
+}
+
+func (r *bulkReport) fail(line int, id string, msg string) {
+	r.Failed++
+	r.Results = append(r.Results, bulkResult{Line: line, ID: id, Status: "failed", Error: msg})
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+// failingBulkStore fails every BulkUpsert after the first succeeded
+type failingBulkStore struct {
+	storage.Storage
+	succeeded int
+}
+
+func (s *failingBulkStore) BulkUpsert(ctx context.Context, titles []*title.Title, mode storage.BulkMode) ([]storage.BulkResult, error) {
+	if s.succeeded == 0 {
+		return nil, errors.New("connection lost")
+	}
+	s.succeeded--
+	return s.Storage.BulkUpsert(ctx, titles, mode)
+}
+
+func bulkImport(t *testing.T, a *API, body string) (*httptest.ResponseRecorder, *bulkReport) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/titles:bulk", strings.NewReader(body))
+	req.Header.Set("Content-Type", ndjsonContentType)
+	w := httptest.NewRecorder()
+	a.BulkTitlesHandler(w, req)
+
+	report := &bulkReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), report); err != nil {
+		t.Fatalf("bulk import response isn't a report: %s: %s", err, w.Body.String())
+	}
+	return w, report
+}
+
+func TestBulkTitlesHandler(t *testing.T) {
+	a := newTestAPI(t)
+	addTestTitles(t, a, &title.Title{ID: "existing", Name: "Existing"})
+
+	body := strings.Join([]string{
+		`{"id": "new", "name": "New"}`,
+		``,
+		`{"id": "existing", "name": "Replaced"}`,
+		`not json`,
+		`{"name": "No ID"}`,
+	}, "\n")
+
+	w, report := bulkImport(t, a, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if report.Created != 1 || report.Updated != 1 || report.Failed != 2 || report.Unknown != 0 {
+		t.Errorf("report = %+v, want 1 created, 1 updated and 2 failed", report)
+	}
+
+	want := []struct {
+		line   int
+		status string
+	}{{1, "created"}, {3, "updated"}, {4, "failed"}, {5, "failed"}}
+	if len(report.Results) != len(want) {
+		t.Fatalf("results = %+v, want %d", report.Results, len(want))
+	}
+	for i, r := range report.Results {
+		if r.Line != want[i].line || r.Status != want[i].status {
+			t.Errorf("result %d = line %d %s, want line %d %s", i, r.Line, r.Status, want[i].line, want[i].status)
+		}
+	}
+}
+
+func TestBulkTitlesHandlerStorageFailure(t *testing.T) {
+	a := newTestAPI(t)
+	a.Storage = &failingBulkStore{Storage: a.Storage, succeeded: 1}
+
+	lines := []string{}
+	for i := 1; i <= bulkBatchSize+bulkBatchSize/2; i++ {
+		lines = append(lines, fmt.Sprintf(`{"id": "title-%d"}`, i))
+	}
+
+	w, report := bulkImport(t, a, strings.Join(lines, "\n"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	// the first batch was written, and the results of the second are unknown
+	if report.Created != bulkBatchSize || report.Unknown != bulkBatchSize/2 || report.Error == "" {
+		t.Errorf("report has %d created, %d unknown and error '%s', want %d created, %d unknown and an error",
+			report.Created, report.Unknown, report.Error, bulkBatchSize, bulkBatchSize/2)
+	}
+	if last := report.Results[len(report.Results)-1]; last.Line != len(lines) || last.Status != "unknown" {
+		t.Errorf("last result = %+v, want line %d unknown", last, len(lines))
+	}
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	// time zones are embedded, so that tz works without them being installed
+	_ "time/tzdata"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+const (
+	dailyDateLayout = "2006-01-02"
+	// maxDailyCachePeriods is the most periods (for any set of filters) which have their picks cached
+	// when there are more, the cache is cleared
+	maxDailyCachePeriods = 1000
+	// dailyCacheMaxAge is how long picks are cached, so that titles written by other instances are picked up
+	dailyCacheMaxAge = 10 * time.Minute
+	// dailyPickTimeout bounds choosing picks, which isn't cancelled with the request as other requests may wait for it
+	dailyPickTimeout = 30 * time.Second
+)
+
+// timeNow is the current time, which tests can change
+var timeNow = time.Now
+
+// dailyCache memoises the picks for periods of days, by query and period
+// the picks only depend on the titles in storage, so it's cleared whenever they are written
+type dailyCache struct {
+	lock    sync.Mutex
+	periods map[string]*dailyPeriod
+}
+
+// dailyPeriod is the picks for the days of a period, in order
+// its lock is held while choosing the picks, so that concurrent requests don't choose them more than once
+type dailyPeriod struct {
+	lock   sync.Mutex
+	picks  []*title.Title
+	chosen time.Time
+}
+
+// DailyTitleHandler picks a title of the day, the same for every request with the same filters on the same date
+// the date is in the time zone of the 'tz' parameter (UTC by default), and titles aren't repeated within DailyNoRepeatDays
+func (a *API) DailyTitleHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	location := time.UTC
+	if tz := query.Get("tz"); tz != "" {
+		var err error
+		if location, err = time.LoadLocation(tz); err != nil {
+			http.Error(w, fmt.Sprintf("tz query parameter is not a known time zone: '%s'", tz), http.StatusBadRequest)
+			return
+		}
+	}
+	if hasAnyParam(query, "count", "seed") {
+		http.Error(w, "count and seed query parameters can't be used for the title of the day", http.StatusBadRequest)
+		return
+	}
+
+	q, err := parseTitleQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the pick only depends on the date, so the time zone isn't part of the query it's cached by
+	query.Del("tz")
+	now := timeNow().In(location)
+
+	title, err := a.dailyPick(query.Encode(), q, now.Format(dailyDateLayout))
+	if err != nil {
+		log.Printf("ERROR: Failed to get title of the day from storage: %s", err)
+		http.Error(w, "Failed to get title of the day from storage", http.StatusInternalServerError)
+		return
+	}
+
+	if title == nil {
+		http.Error(w, "No matching title found", http.StatusNotFound)
+		return
+	}
+
+	bytes, err := json.Marshal(title)
+	if err != nil {
+		log.Printf("ERROR: Could not serialise title: %s", err)
+		http.Error(w, "Could not serialise title", http.StatusInternalServerError)
+		return
+	}
+
+	// the pick can be cached by the client until midnight in the time zone
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, location)
+
+	addDefaultResponseHeaders(w)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(midnight.Sub(now).Seconds())))
+	fmt.Fprint(w, string(bytes))
+}
+
+// dailyPick finds the pick for the query on the date, which only depends on the date and the titles in storage
+//
+// Days are split into periods of DailyNoRepeatDays+1 days, and each day's pick is its place in a seeded sample
+// for its period, so picks within a period are different. Any two days within DailyNoRepeatDays of each other
+// are in the same or neighbouring periods, so the samples for odd periods exclude the titles sampled for the even
+// periods either side. Titles are only repeated within DailyNoRepeatDays when too few titles match the query.
+func (a *API) dailyPick(key string, q *titleQuery, date string) (*title.Title, error) {
+	day, err := time.Parse(dailyDateLayout, date)
+	if err != nil {
+		return nil, err
+	}
+	number := int(day.Unix() / (24 * 60 * 60))
+
+	length := a.DailyNoRepeatDays + 1
+	if length < 1 {
+		length = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dailyPickTimeout)
+	defer cancel()
+
+	picks, err := a.periodPicks(ctx, key, q, number/length, length)
+	if err != nil || len(picks) == 0 {
+		return nil, err
+	}
+	return picks[(number%length)%len(picks)], nil
+}
+
+// periodPicks gets the picks for the days of the period, from the cache or by choosing them
+func (a *API) periodPicks(ctx context.Context, key string, q *titleQuery, period int, length int) ([]*title.Title, error) {
+	dp := a.daily.period(fmt.Sprintf("%s/%d/%d", key, length, period))
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	if !dp.chosen.IsZero() && time.Since(dp.chosen) < dailyCacheMaxAge {
+		return dp.picks, nil
+	}
+
+	picks, err := a.samplePeriod(ctx, q, period, length, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if period%2 == 1 {
+		exclude := []string{}
+		for _, neighbour := range []int{period - 1, period + 1} {
+			neighbourPicks, err := a.periodPicks(ctx, key, q, neighbour, length)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range neighbourPicks {
+				exclude = append(exclude, t.ID)
+			}
+		}
+
+		others, err := a.samplePeriod(ctx, q, period, length, exclude)
+		if err != nil {
+			return nil, err
+		}
+		picks = fillPicks(others, picks, length)
+	}
+
+	// nothing is cached without picks, so titles added later can still be picked
+	if len(picks) > 0 {
+		dp.picks, dp.chosen = picks, time.Now()
+	}
+	return picks, nil
+}
+
+// samplePeriod chooses the seeded sample of titles for the period, excluding the ids
+func (a *API) samplePeriod(ctx context.Context, q *titleQuery, period int, length int, exclude []string) ([]*title.Title, error) {
+	start := time.Unix(int64(period*length)*24*60*60, 0).UTC().Format(dailyDateLayout)
+	opts := storage.SampleOptions{
+		Count:   length,
+		Weight:  q.weight,
+		Seed:    fmt.Sprintf("daily:%s:%d", start, length),
+		Filters: append(q.filters(), title.ExcludeIDsFilter{IDs: exclude}),
+	}
+	return a.Storage.SampleTitles(ctx, opts)
+}
+
+// fillPicks tops up the picks with titles from the fallback sample (which aren't already picked), up to the length
+func fillPicks(picks []*title.Title, fallback []*title.Title, length int) []*title.Title {
+	picked := map[string]bool{}
+	for _, t := range picks {
+		picked[t.ID] = true
+	}
+	for _, t := range fallback {
+		if len(picks) >= length {
+			break
+		}
+		if !picked[t.ID] {
+			picks = append(picks, t)
+		}
+	}
+	return picks
+}
+
+// period gets the cached picks for the period (by key), adding them if they aren't cached
+func (c *dailyCache) period(key string) *dailyPeriod {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.periods == nil || len(c.periods) >= maxDailyCachePeriods {
+		c.periods = map[string]*dailyPeriod{}
+	}
+	dp := c.periods[key]
+	if dp == nil {
+		dp = &dailyPeriod{}
+		c.periods[key] = dp
+	}
+	return dp
+}
+
+// clear removes every cached pick, for when titles are written
+func (c *dailyCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.periods = nil
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+// setTime fixes the current time for the test
+func setTime(t *testing.T, now time.Time) {
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+}
+
+func dailyTestStorage(t *testing.T, count int) storage.Storage {
+	a := newTestAPI(t)
+	for i := 1; i <= count; i++ {
+		addTestTitles(t, a, &title.Title{
+			ID:     fmt.Sprintf("title-%d", i),
+			Name:   fmt.Sprintf("Title %d", i),
+			Scores: map[string]int{"metascore": i % 100},
+		})
+	}
+	return a.Storage
+}
+
+// dailyTitle gets the title of the day at the time, failing the test unless there is one
+func dailyTitle(t *testing.T, a *API, now time.Time, query string) (*title.Title, http.Header) {
+	t.Helper()
+	setTime(t, now)
+
+	req := httptest.NewRequest(http.MethodGet, "/title/daily?"+query, nil)
+	w := httptest.NewRecorder()
+	a.DailyTitleHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("daily '%s' at %s: status = %d, want %d: %s", query, now, w.Code, http.StatusOK, w.Body.String())
+	}
+
+	tt := &title.Title{}
+	if err := json.Unmarshal(w.Body.Bytes(), tt); err != nil {
+		t.Fatalf("daily '%s' at %s: response isn't a title: %s", query, now, err)
+	}
+	return tt, w.Header()
+}
+
+var dailyTestStart = time.Date(2026, time.October, 16, 11, 30, 0, 0, time.UTC)
+
+func dailyTestDay(day int) time.Time {
+	return dailyTestStart.AddDate(0, 0, day)
+}
+
+func TestDailyTitleDeterministic(t *testing.T) {
+	s := dailyTestStorage(t, 50)
+	days := 40
+
+	// each instance starts with nothing cached, and the second asks for the days in reverse
+	first := &API{Storage: s, DailyNoRepeatDays: 7}
+	second := &API{Storage: s, DailyNoRepeatDays: 7}
+
+	picks := make([]string, days)
+	for day := 0; day < days; day++ {
+		tt, _ := dailyTitle(t, first, dailyTestDay(day), "")
+		picks[day] = tt.ID
+	}
+	for day := days - 1; day >= 0; day-- {
+		if tt, _ := dailyTitle(t, second, dailyTestDay(day), ""); tt.ID != picks[day] {
+			t.Errorf("day %d: second instance picked %s, want %s", day, tt.ID, picks[day])
+		}
+	}
+
+	// the time of day doesn't matter
+	if tt, _ := dailyTitle(t, first, dailyTestDay(3).Add(12*time.Hour), ""); tt.ID != picks[3] {
+		t.Errorf("day 3 evening: picked %s, want %s", tt.ID, picks[3])
+	}
+
+	// filters are part of the pick
+	for day := 0; day < days; day++ {
+		tt, _ := dailyTitle(t, first, dailyTestDay(day), "exclude="+picks[day])
+		if tt.ID == picks[day] {
+			t.Errorf("day %d: picked %s, which is excluded", day, tt.ID)
+		}
+	}
+}
+
+func TestDailyTitleNoRepeat(t *testing.T) {
+	s := dailyTestStorage(t, 100)
+
+	for _, query := range []string{"", "weight=score"} {
+		for _, window := range []int{0, 1, 7, 30} {
+			a := &API{Storage: s, DailyNoRepeatDays: window}
+
+			picks := []string{}
+			for day := 0; day < 150; day++ {
+				tt, _ := dailyTitle(t, a, dailyTestDay(day), query)
+				for before := 1; before <= window && before <= day; before++ {
+					if picks[day-before] == tt.ID {
+						t.Errorf("'%s' window %d: %s picked on day %d and %d days before", query, window, tt.ID, day, before)
+					}
+				}
+				picks = append(picks, tt.ID)
+			}
+		}
+	}
+}
+
+func TestDailyTitleFewTitles(t *testing.T) {
+	a := &API{Storage: dailyTestStorage(t, 3), DailyNoRepeatDays: 30}
+
+	// with fewer titles than days in the window, they are repeated
+	picked := map[string]bool{}
+	for day := 0; day < 10; day++ {
+		tt, _ := dailyTitle(t, a, dailyTestDay(day), "")
+		picked[tt.ID] = true
+	}
+	if len(picked) != 3 {
+		t.Errorf("picked %v, want all 3 titles", picked)
+	}
+}
+
+func TestDailyTitleTimeZone(t *testing.T) {
+	a := &API{Storage: dailyTestStorage(t, 50), DailyNoRepeatDays: 7}
+
+	today, header := dailyTitle(t, a, dailyTestStart, "")
+	if got := header.Get("Cache-Control"); got != "public, max-age=45000" {
+		t.Errorf("UTC Cache-Control = %s, want max-age until midnight", got)
+	}
+	tomorrow, _ := dailyTitle(t, a, dailyTestDay(1), "")
+
+	// at 11:30 UTC it's already tomorrow in Kiritimati (UTC+14) but still today in Los Angeles
+	kiritimati, header := dailyTitle(t, a, dailyTestStart, "tz=Pacific/Kiritimati")
+	if kiritimati.ID != tomorrow.ID {
+		t.Errorf("Kiritimati picked %s, want tomorrow's %s", kiritimati.ID, tomorrow.ID)
+	}
+	if got := header.Get("Cache-Control"); got != "public, max-age=81000" {
+		t.Errorf("Kiritimati Cache-Control = %s, want max-age until midnight there", got)
+	}
+	if la, _ := dailyTitle(t, a, dailyTestStart, "tz=America/Los_Angeles"); la.ID != today.ID {
+		t.Errorf("Los Angeles picked %s, want today's %s", la.ID, today.ID)
+	}
+
+	// the date rolls over at midnight in the time zone
+	midnight := time.Date(2026, time.October, 16, 7, 0, 0, 0, time.UTC)
+	if la, _ := dailyTitle(t, a, midnight.Add(-time.Second), "tz=America/Los_Angeles"); la.ID == today.ID {
+		t.Errorf("Los Angeles just before midnight picked today's %s", la.ID)
+	}
+	if la, _ := dailyTitle(t, a, midnight, "tz=America/Los_Angeles"); la.ID != today.ID {
+		t.Errorf("Los Angeles at midnight picked %s, want today's %s", la.ID, today.ID)
+	}
+
+	setTime(t, dailyTestStart)
+	req := httptest.NewRequest(http.MethodGet, "/title/daily?tz=Mars/Olympus_Mons", nil)
+	w := httptest.NewRecorder()
+	a.DailyTitleHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown tz: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDailyTitleWrites(t *testing.T) {
+	a := &API{Storage: dailyTestStorage(t, 50), DailyNoRepeatDays: 7}
+
+	before, _ := dailyTitle(t, a, dailyTestStart, "")
+	if w := titleRequest(a, http.MethodDelete, before.ID, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete %s: status = %d, want %d", before.ID, w.Code, http.StatusNoContent)
+	}
+
+	// the cached pick was deleted, so another is picked
+	after, _ := dailyTitle(t, a, dailyTestStart, "")
+	if after.ID == before.ID {
+		t.Errorf("picked %s after it was deleted", after.ID)
+	}
+
+	w := titleRequest(a, http.MethodPatch, after.ID, `{"name": "Renamed"}`, map[string]string{"Content-Type": mergePatchContentType})
+	if w.Code != http.StatusOK {
+		t.Fatalf("patch %s: status = %d, want %d", after.ID, w.Code, http.StatusOK)
+	}
+	if patched, _ := dailyTitle(t, a, dailyTestStart, ""); patched.ID != after.ID || patched.Name != "Renamed" {
+		t.Errorf("picked %s (%s) after the patch, want %s renamed", patched.ID, patched.Name, after.ID)
+	}
+}
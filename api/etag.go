@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+// titleETag is the (strong) entity tag of the title, which changes with every revision
+func titleETag(t *title.Title) string {
+	return fmt.Sprintf(`"%d"`, t.Revision)
+}
+
+// splitETags splits an If-Match or If-None-Match header into its entity tags
+func splitETags(header string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// noneMatch checks the If-None-Match header, which uses weak comparison, against the title
+// it returns false if the client already has the current revision
+func noneMatch(req *http.Request, t *title.Title) bool {
+	etag := titleETag(t)
+	for _, tag := range splitETags(req.Header.Get("If-None-Match")) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return false
+		}
+	}
+	return true
+}
+
+// ifMatchRevision gets the revision which the If-Match header requires the title to be at
+// storage.AnyRevision is returned when there is no header (or it's "*"), and ok is false if the header can never match
+func (a *API) ifMatchRevision(req *http.Request, id string) (revision int, ok bool, err error) {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return storage.AnyRevision, true, nil
+	}
+
+	revisions := []int{}
+	for _, tag := range splitETags(header) {
+		if tag == "*" {
+			return storage.AnyRevision, true, nil
+		}
+		// If-Match uses strong comparison, so weak tags never match
+		if !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) || len(tag) < 2 {
+			continue
+		}
+		if r, err := strconv.Atoi(tag[1 : len(tag)-1]); err == nil && r >= 0 {
+			revisions = append(revisions, r)
+		}
+	}
+
+	switch len(revisions) {
+	case 0:
+		return 0, false, nil
+	case 1:
+		return revisions[0], true, nil
+	}
+
+	// with a list of tags, the write must happen at whichever revision the title is currently at (if listed)
+	t, err := a.Storage.GetTitle(req.Context(), id)
+	if err != nil || t == nil {
+		return storage.AnyRevision, true, err
+	}
+	for _, r := range revisions {
+		if r == t.Revision {
+			return r, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// checkIfMatch gets the revision a write must happen at from the If-Match header
+// if the precondition can't be met (or is required but missing), the error is written and ok is false
+func (a *API) checkIfMatch(w http.ResponseWriter, req *http.Request, id string) (revision int, ok bool) {
+	if a.RequireIfMatch && req.Header.Get("If-Match") == "" {
+		http.Error(w, "If-Match is required to change a title", http.StatusPreconditionRequired)
+		return 0, false
+	}
+
+	revision, ok, err := a.ifMatchRevision(req, id)
+	if err != nil {
+		writeStorageError(w, "get title from storage", err)
+		return 0, false
+	}
+	if !ok {
+		http.Error(w, "If-Match does not match the current revision", http.StatusPreconditionFailed)
+		return 0, false
+	}
+	return revision, true
+}
+
+// writeConditionalStorageError is writeStorageError for writes which may have an If-Match revision
+// where a conflict with the revision means the precondition failed
+func writeConditionalStorageError(w http.ResponseWriter, action string, err error, revision int) {
+	if revision != storage.AnyRevision && errors.Is(err, storage.ErrConflict) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	writeStorageError(w, action, err)
+}
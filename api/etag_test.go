@@ -0,0 +1,128 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+func TestSplitETags(t *testing.T) {
+	tests := map[string][]string{
+		``:                   {},
+		`"1"`:                {`"1"`},
+		` "1" , W/"2",, "3"`: {`"1"`, `W/"2"`, `"3"`},
+		`*`:                  {`*`},
+	}
+	for header, want := range tests {
+		if got := splitETags(header); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitETags(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestGetTitleIfNoneMatch(t *testing.T) {
+	a := newTestAPI(t)
+	addTestTitles(t, a, &title.Title{ID: "title", Name: "Title"})
+
+	tests := []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{"", http.StatusOK},
+		{`"1"`, http.StatusNotModified},
+		{`W/"1"`, http.StatusNotModified},
+		{`"0", "1"`, http.StatusNotModified},
+		{`*`, http.StatusNotModified},
+		{`"2"`, http.StatusOK},
+		{`1`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := titleRequest(a, http.MethodGet, "title", "", map[string]string{"If-None-Match": tt.ifNoneMatch})
+		if w.Code != tt.want {
+			t.Errorf("If-None-Match '%s': status = %d, want %d", tt.ifNoneMatch, w.Code, tt.want)
+		}
+		if etag := w.Header().Get("ETag"); etag != `"1"` {
+			t.Errorf("If-None-Match '%s': ETag = %s, want \"1\"", tt.ifNoneMatch, etag)
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("If-None-Match '%s': 304 has a body: %s", tt.ifNoneMatch, w.Body.String())
+		}
+	}
+}
+
+func TestUpdateTitleIfMatch(t *testing.T) {
+	tests := []struct {
+		ifMatch string
+		want    int
+	}{
+		{"", http.StatusOK},
+		{`"1"`, http.StatusOK},
+		{`*`, http.StatusOK},
+		{`"0", "1"`, http.StatusOK},
+		{`"2"`, http.StatusPreconditionFailed},
+		{`"0", "2"`, http.StatusPreconditionFailed},
+		// If-Match uses strong comparison
+		{`W/"1"`, http.StatusPreconditionFailed},
+		{`1`, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		a := newTestAPI(t)
+		addTestTitles(t, a, &title.Title{ID: "title", Name: "Title"})
+
+		headers := map[string]string{"If-Match": tt.ifMatch}
+		w := titleRequest(a, http.MethodPut, "title", `{"id": "title", "name": "Updated"}`, headers)
+		if w.Code != tt.want {
+			t.Errorf("PUT If-Match '%s': status = %d, want %d", tt.ifMatch, w.Code, tt.want)
+		}
+		if w.Code == http.StatusOK && w.Header().Get("ETag") != `"2"` {
+			t.Errorf("PUT If-Match '%s': ETag = %s, want \"2\"", tt.ifMatch, w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestPatchTitleIfMatch(t *testing.T) {
+	a := newTestAPI(t)
+	addTestTitles(t, a, &title.Title{ID: "title", Name: "Title"})
+	headers := map[string]string{"Content-Type": mergePatchContentType, "If-Match": `"1"`}
+
+	w := titleRequest(a, http.MethodPatch, "title", `{"name": "First"}`, headers)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("first patch: status = %d and ETag = %s, want 200 and \"2\"", w.Code, w.Header().Get("ETag"))
+	}
+
+	// a second writer with the same revision has lost the race
+	w = titleRequest(a, http.MethodPatch, "title", `{"name": "Second"}`, headers)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("second patch: status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+
+	w = titleRequest(a, http.MethodGet, "title", "", nil)
+	if got := w.Body.String(); !strings.Contains(got, `"name":"First"`) {
+		t.Errorf("title after patches = %s, want the first patch", got)
+	}
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	a := newTestAPI(t)
+	a.RequireIfMatch = true
+	addTestTitles(t, a, &title.Title{ID: "title", Name: "Title"})
+
+	w := titleRequest(a, http.MethodPut, "title", `{"id": "title", "name": "Updated"}`, nil)
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("PUT without If-Match: status = %d, want %d", w.Code, http.StatusPreconditionRequired)
+	}
+	patch := map[string]string{"Content-Type": mergePatchContentType}
+	w = titleRequest(a, http.MethodPatch, "title", `{"name": "Patched"}`, patch)
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("PATCH without If-Match: status = %d, want %d", w.Code, http.StatusPreconditionRequired)
+	}
+
+	patch["If-Match"] = `"1"`
+	w = titleRequest(a, http.MethodPatch, "title", `{"name": "Patched"}`, patch)
+	if w.Code != http.StatusOK {
+		t.Errorf("PATCH with If-Match: status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
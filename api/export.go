@@ -0,0 +1,281 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+const (
+	csvContentType = "text/csv"
+	// exportFlushInterval is the number of titles written between each flush of the response
+	exportFlushInterval = 100
+)
+
+// exportContentTypes are the formats titles can be exported in, the first is the default
+var exportContentTypes = []string{ndjsonContentType, csvContentType, "application/json"}
+
+// titleEncoder writes titles in an export format
+type titleEncoder interface {
+	encode(t *title.Title) error
+	// close writes anything needed after the last title
+	close() error
+}
+
+// ExportTitlesHandler streams every title in storage, as NDJSON, CSV or a JSON array (chosen by the Accept header)
+func (a *API) ExportTitlesHandler(w http.ResponseWriter, req *http.Request) {
+	contentType := negotiateContentType(req.Header.Get("Accept"), exportContentTypes)
+	if contentType == "" {
+		http.Error(w, fmt.Sprintf("can only export as one of: %s", strings.Join(exportContentTypes, ", ")), http.StatusNotAcceptable)
+		return
+	}
+
+	buffer := bufio.NewWriter(w)
+	var encoder titleEncoder
+
+	switch contentType {
+	case csvContentType:
+		// the flattened columns depend on every title, so they are found before anything is written
+		columns, err := a.csvColumns(req)
+		if err != nil {
+			writeStorageError(w, "get titles from storage", err)
+			return
+		}
+		encoder = &csvEncoder{writer: csv.NewWriter(buffer), columns: columns}
+	case ndjsonContentType:
+		encoder = &ndjsonEncoder{encoder: json.NewEncoder(buffer)}
+	default:
+		encoder = &jsonArrayEncoder{writer: buffer}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+
+	count := 0
+	err := a.Storage.EachTitle(req.Context(), func(t *title.Title) error {
+		if err := encoder.encode(t); err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushInterval == 0 {
+			return flush(w, buffer)
+		}
+		return nil
+	})
+	if err == nil {
+		err = encoder.close()
+	}
+	if err == nil {
+		err = flush(w, buffer)
+	}
+
+	if err != nil {
+		// the status has already been sent, so abort the response to show the client that it is incomplete
+		log.Printf("ERROR: failed to export titles after %d titles: %s", count, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// csvColumns finds every score kind and service name, to flatten into columns
+func (a *API) csvColumns(req *http.Request) (*csvColumns, error) {
+	kinds := map[string]bool{}
+	services := map[string]bool{}
+
+	err := a.Storage.EachTitle(req.Context(), func(t *title.Title) error {
+		for kind := range t.Scores {
+			kinds[kind] = true
+		}
+		for name := range t.Services {
+			services[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &csvColumns{scoreKinds: sortedKeys(kinds), services: sortedKeys(services)}, nil
+}
+
+// flush writes everything buffered so far to the client
+func flush(w http.ResponseWriter, buffer *bufio.Writer) error {
+	if err := buffer.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonEncoder) encode(t *title.Title) error {
+	// json.Encoder ends every value with a newline
+	return e.encoder.Encode(t)
+}
+
+func (e *ndjsonEncoder) close() error {
+	return nil
+}
+
+type jsonArrayEncoder struct {
+	writer  *bufio.Writer
+	started bool
+}
+
+func (e *jsonArrayEncoder) encode(t *title.Title) error {
+	bytes, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("could not serialise title '%s': %s", t.ID, err)
+	}
+
+	separator := ","
+	if !e.started {
+		separator = "["
+		e.started = true
+	}
+
+	e.writer.WriteString(separator)
+	_, err = e.writer.Write(bytes)
+	return err
+}
+
+func (e *jsonArrayEncoder) close() error {
+	if !e.started {
+		_, err := e.writer.WriteString("[]")
+		return err
+	}
+	_, err := e.writer.WriteString("]")
+	return err
+}
+
+// csvColumns are the flattened columns of the CSV export, after the fixed title columns
+type csvColumns struct {
+	scoreKinds []string
+	services   []string
+}
+
+// csvEncoder writes a row per title, with a column per score kind (scores.<kind>) and service (services.<name>.id and .url)
+// genres are joined with ';' and directories are left out
+type csvEncoder struct {
+	writer  *csv.Writer
+	columns *csvColumns
+	started bool
+}
+
+func (e *csvEncoder) encode(t *title.Title) error {
+	if !e.started {
+		if err := e.writer.Write(e.header()); err != nil {
+			return err
+		}
+		e.started = true
+	}
+
+	row := []string{t.ID, t.Name, strconv.Itoa(t.Year), t.Description, strings.Join(t.Genres, ";"), t.Poster, strconv.Itoa(t.Revision)}
+	for _, kind := range e.columns.scoreKinds {
+		score, ok := t.Scores[kind]
+		if ok {
+			row = append(row, strconv.Itoa(score))
+		} else {
+			row = append(row, "")
+		}
+	}
+	for _, name := range e.columns.services {
+		if s := t.Services[name]; s != nil {
+			row = append(row, s.ID, s.URL)
+		} else {
+			row = append(row, "", "")
+		}
+	}
+
+	return e.writer.Write(row)
+}
+
+func (e *csvEncoder) header() []string {
+	header := []string{"id", "name", "year", "description", "genres", "poster", "revision"}
+	for _, kind := range e.columns.scoreKinds {
+		header = append(header, fmt.Sprintf("scores.%s", kind))
+	}
+	for _, name := range e.columns.services {
+		header = append(header, fmt.Sprintf("services.%s.id", name), fmt.Sprintf("services.%s.url", name))
+	}
+	return header
+}
+
+func (e *csvEncoder) close() error {
+	// the header is written even if there are no titles
+	if !e.started {
+		if err := e.writer.Write(e.header()); err != nil {
+			return err
+		}
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// negotiateContentType picks the supported content type with the highest quality in the Accept header
+// no Accept header (or */*) means the first supported type, and "" is returned if none are acceptable
+func negotiateContentType(accept string, supported []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return supported[0]
+	}
+
+	best, bestQuality := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= bestQuality {
+			continue
+		}
+
+		for _, s := range supported {
+			if mediaTypeMatches(mediaType, s) {
+				best, bestQuality = s, quality
+				break
+			}
+		}
+	}
+
+	return best
+}
+
+// mediaTypeMatches checks if the media type (which may have wildcards e.g. text/*) matches the content type
+func mediaTypeMatches(mediaType string, contentType string) bool {
+	if mediaType == "*/*" || mediaType == contentType {
+		return true
+	}
+	if strings.HasSuffix(mediaType, "/*") {
+		return strings.HasPrefix(contentType, strings.TrimSuffix(mediaType, "*"))
+	}
+	return false
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	tests := map[string]string{
+		"":                                     ndjsonContentType,
+		"*/*":                                  ndjsonContentType,
+		"text/csv":                             csvContentType,
+		"text/*":                               csvContentType,
+		"application/json":                     "application/json",
+		"application/json;q=0.5, text/csv":     csvContentType,
+		"text/csv;q=0.2, application/*;q=0.9":  ndjsonContentType,
+		"text/html, application/json;q=0.1":    "application/json",
+		"text/html":                            "",
+		"text/csv;q=nonsense, application/xml": "",
+	}
+	for accept, want := range tests {
+		if got := negotiateContentType(accept, exportContentTypes); got != want {
+			t.Errorf("negotiateContentType('%s') = '%s', want '%s'", accept, got, want)
+		}
+	}
+}
+
+func exportTitles(t *testing.T, a *API, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/titles:export", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	a.ExportTitlesHandler(w, req)
+
+	if want := negotiateContentType(accept, exportContentTypes); w.Code == http.StatusOK && w.Header().Get("Content-Type") != want {
+		t.Errorf("Accept '%s': Content-Type = %s, want %s", accept, w.Header().Get("Content-Type"), want)
+	}
+	return w
+}
+
+func exportTestAPI(t *testing.T) *API {
+	a := newTestAPI(t)
+	addTestTitles(t, a,
+		&title.Title{
+			ID:       "drama",
+			Name:     "Drama, \"quoted\"",
+			Year:     2001,
+			Genres:   []string{"drama", "thriller"},
+			Scores:   map[string]int{"metascore": 80},
+			Services: map[string]*title.Service{"netflix": {ID: "n1", URL: "https://netflix.com/n1"}},
+		},
+		&title.Title{
+			ID:     "comedy",
+			Name:   "Comedy",
+			Scores: map[string]int{"imdb": 7},
+		},
+	)
+	return a
+}
+
+func TestExportTitlesNDJSON(t *testing.T) {
+	w := exportTitles(t, exportTestAPI(t), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	ids := []string{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		tt := &title.Title{}
+		if err := json.Unmarshal(scanner.Bytes(), tt); err != nil {
+			t.Fatalf("line '%s' isn't a title: %s", scanner.Text(), err)
+		}
+		ids = append(ids, tt.ID)
+	}
+	if len(ids) != 2 {
+		t.Errorf("exported %v, want both titles", ids)
+	}
+}
+
+func TestExportTitlesJSON(t *testing.T) {
+	w := exportTitles(t, exportTestAPI(t), "application/json")
+
+	titles := []*title.Title{}
+	if err := json.Unmarshal(w.Body.Bytes(), &titles); err != nil {
+		t.Fatalf("export isn't a JSON array: %s: %s", err, w.Body.String())
+	}
+	if len(titles) != 2 {
+		t.Errorf("exported %d titles, want 2", len(titles))
+	}
+
+	w = exportTitles(t, newTestAPI(t), "application/json")
+	if got := w.Body.String(); got != "[]" {
+		t.Errorf("empty export = %s, want []", got)
+	}
+}
+
+func TestExportTitlesCSV(t *testing.T) {
+	w := exportTitles(t, exportTestAPI(t), "text/csv")
+
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("export isn't CSV: %s", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("exported %d rows, want a header and 2 titles", len(rows))
+	}
+
+	header := []string{"id", "name", "year", "description", "genres", "poster", "revision",
+		"scores.imdb", "scores.metascore", "services.netflix.id", "services.netflix.url"}
+	if !reflect.DeepEqual(rows[0], header) {
+		t.Errorf("header = %q, want %q", rows[0], header)
+	}
+
+	drama := []string{"drama", "Drama, \"quoted\"", "2001", "", "drama;thriller", "", "1", "", "80", "n1", "https://netflix.com/n1"}
+	comedy := []string{"comedy", "Comedy", "0", "", "", "", "1", "7", "", "", ""}
+	for _, row := range rows[1:] {
+		want := comedy
+		if row[0] == "drama" {
+			want = drama
+		}
+		if !reflect.DeepEqual(row, want) {
+			t.Errorf("row = %q, want %q", row, want)
+		}
+	}
+
+	w = exportTitles(t, newTestAPI(t), "text/csv")
+	if got := strings.TrimSpace(w.Body.String()); got != strings.Join(header[:7], ",") {
+		t.Errorf("empty export = %s, want only the header", got)
+	}
+}
+
+func TestExportTitlesNotAcceptable(t *testing.T) {
+	w := exportTitles(t, exportTestAPI(t), "text/html")
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+}
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+// The 'q' query parameter is a boolean expression over title filters, e.g.
+//
+//	(Comedy OR Animation) AND NOT Horror on netflix OR prime
+//
+// grammar (keywords are case insensitive, AND binds tighter than OR):
+//
+//	expression := or
+//	or         := and { "OR" and }
+//	and        := not { ["AND"] not }
+//	not        := "NOT" not | primary
+//	primary    := "(" or ")" | "ON" name { "OR" name } | term
+//	term       := genre | "genre:" name | "service:" name | "year:" range | "score[.<kind>]:" range
+//	range      := int | [int] ".." [int]
+//
+// a bare word (or "quoted string") is a genre. Note that "ON" consumes every following "OR name",
+// so "on netflix OR prime" means either service, use brackets to OR a service with anything else
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenQuoted
+	tokenOpen
+	tokenClose
+	tokenEnd
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// pos is the (1 indexed) position of the token in the expression
+	pos int
+}
+
+// expressionError is a syntax error in an expression, at a specific position
+type expressionError struct {
+	pos int
+	msg string
+}
+
+func (e *expressionError) Error() string {
+	return fmt.Sprintf("invalid q expression at position %d: %s", e.pos, e.msg)
+}
+
+type expressionParser struct {
+	tokens []token
+	next   int
+}
+
+// parseExpression parses a boolean expression (see grammar above) to a tree of title filters
+func parseExpression(expression string) (title.Filter, error) {
+	tokens, err := tokenise(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &expressionParser{tokens: tokens}
+	if p.peek().kind == tokenEnd {
+		return nil, &expressionError{pos: p.peek().pos, msg: "expression is empty"}
+	}
+
+	filter, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, &expressionError{pos: t.pos, msg: fmt.Sprintf("unexpected '%s'", t.text)}
+	}
+
+	return filter, nil
+}
+
+func tokenise(expression string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen, text: "(", pos: i + 1})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose, text: ")", pos: i + 1})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &expressionError{pos: i + 1, msg: "unterminated quoted string"}
+			}
+			tokens = append(tokens, token{kind: tokenQuoted, text: string(runes[i+1 : end]), pos: i + 1})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()"`, runes[end]) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: string(runes[i:end]), pos: i + 1})
+			i = end
+		}
+	}
+
+	return append(tokens, token{kind: tokenEnd, text: "end of expression", pos: len(runes) + 1}), nil
+}
+
+func (p *expressionParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *expressionParser) pop() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEnd {
+		p.next++
+	}
+	return t
+}
+
+// isKeyword checks if the token is the (unquoted) keyword
+func (t token) isKeyword(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func (p *expressionParser) or() (title.Filter, error) {
+	filters := []title.Filter{}
+
+	for {
+		f, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+
+		if !p.peek().isKeyword("OR") {
+			break
+		}
+		p.pop()
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return title.OrFilter{Filters: filters}, nil
+}
+
+func (p *expressionParser) and() (title.Filter, error) {
+	filters := []title.Filter{}
+
+	for {
+		f, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+
+		// AND is implied between adjacent terms
+		t := p.peek()
+		if t.isKeyword("AND") {
+			p.pop()
+		} else if t.kind == tokenEnd || t.kind == tokenClose || t.isKeyword("OR") {
+			break
+		}
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return title.AndFilter{Filters: filters}, nil
+}
+
+func (p *expressionParser) not() (title.Filter, error) {
+	if !p.peek().isKeyword("NOT") {
+		return p.primary()
+	}
+	p.pop()
+
+	f, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	return title.NotFilter{Filter: f}, nil
+}
+
+func (p *expressionParser) primary() (title.Filter, error) {
+	t := p.pop()
+
+	switch {
+	case t.kind == tokenOpen:
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.pop(); closing.kind != tokenClose {
+			return nil, &expressionError{pos: closing.pos, msg: fmt.Sprintf("expected ')' but got '%s'", closing.text)}
+		}
+		return f, nil
+	case t.isKeyword("ON"):
+		return p.services()
+	case t.kind == tokenQuoted:
+		return title.IsGenreFilter{Genres: []string{t.text}}, nil
+	case t.kind == tokenWord && !isReserved(t):
+		return parseTerm(t)
+	default:
+		return nil, &expressionError{pos: t.pos, msg: fmt.Sprintf("expected a term but got '%s'", t.text)}
+	}
+}
+
+// services parses the list of services following "ON"
+func (p *expressionParser) services() (title.Filter, error) {
+	services := []string{}
+
+	for {
+		t := p.pop()
+		if !(t.kind == tokenQuoted || (t.kind == tokenWord && !isReserved(t))) {
+			return nil, &expressionError{pos: t.pos, msg: fmt.Sprintf("expected a service but got '%s'", t.text)}
+		}
+		services = append(services, t.text)
+
+		if !p.peek().isKeyword("OR") {
+			break
+		}
+		p.pop()
+	}
+
+	return title.OnServiceFilter{Services: services}, nil
+}
+
+func isReserved(t token) bool {
+	for _, keyword := range []string{"AND", "OR", "NOT", "ON"} {
+		if t.isKeyword(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTerm parses a single (unquoted) word to a filter
+func parseTerm(t token) (title.Filter, error) {
+	parts := strings.SplitN(t.text, ":", 2)
+	if len(parts) == 1 {
+		return title.IsGenreFilter{Genres: []string{t.text}}, nil
+	}
+	field, value := strings.ToLower(parts[0]), parts[1]
+	// position of the value, for errors
+	pos := t.pos + len([]rune(parts[0])) + 1
+
+	if value == "" {
+		return nil, &expressionError{pos: pos, msg: fmt.Sprintf("no value for '%s'", parts[0])}
+	}
+
+	switch {
+	case field == "genre":
+		return title.IsGenreFilter{Genres: []string{value}}, nil
+	case field == "service":
+		return title.OnServiceFilter{Services: []string{value}}, nil
+	case field == "year":
+		min, max, err := parseRange(value, pos)
+		if err != nil {
+			return nil, err
+		}
+		return title.YearBetweenFilter{Min: min, Max: max}, nil
+	case field == "score" || strings.HasPrefix(field, "score."):
+		kind := strings.TrimPrefix(parts[0][len("score"):], ".")
+		if kind == "" {
+			kind = defaultScoreKind
+		}
+		min, max, err := parseRange(value, pos)
+		if err != nil {
+			return nil, err
+		}
+		return title.ScoreBetweenFilter{Kind: kind, Min: min, Max: max}, nil
+	default:
+		return nil, &expressionError{pos: t.pos, msg: fmt.Sprintf("unknown field '%s'", parts[0])}
+	}
+}
+
+// parseRange parses an inclusive range, either a single integer or "min..max" where either side may be omitted
+// an omitted max is returned as 0 (no upper bound), so an explicit max of 0 is an error rather than being unbounded
+func parseRange(value string, pos int) (int, int, error) {
+	bounds := strings.SplitN(value, "..", 2)
+
+	parsed := []int{}
+	// position of the bound, for errors
+	boundPos := pos
+	for i, b := range bounds {
+		if i > 0 {
+			boundPos += len([]rune(bounds[i-1])) + len("..")
+		}
+		if b == "" {
+			parsed = append(parsed, 0)
+			continue
+		}
+		n, err := strconv.Atoi(b)
+		if err != nil {
+			return 0, 0, &expressionError{pos: pos, msg: fmt.Sprintf("'%s' is not an integer range", value)}
+		}
+		if n == 0 && i == len(bounds)-1 {
+			return 0, 0, &expressionError{pos: boundPos, msg: fmt.Sprintf("'%s' has a max of 0, which isn't supported", value)}
+		}
+		parsed = append(parsed, n)
+	}
+
+	if len(parsed) == 1 {
+		return parsed[0], parsed[0], nil
+	}
+	return parsed[0], parsed[1], nil
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+func genre(name string) title.Filter {
+	return title.IsGenreFilter{Genres: []string{name}}
+}
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       title.Filter
+	}{
+		{"Comedy", genre("Comedy")},
+		{`"Science Fiction"`, genre("Science Fiction")},
+		{"genre:Drama", genre("Drama")},
+		{"service:netflix", title.OnServiceFilter{Services: []string{"netflix"}}},
+		{"on netflix", title.OnServiceFilter{Services: []string{"netflix"}}},
+		{"on netflix OR prime", title.OnServiceFilter{Services: []string{"netflix", "prime"}}},
+		{"year:1999", title.YearBetweenFilter{Min: 1999, Max: 1999}},
+		{"year:1990..1999", title.YearBetweenFilter{Min: 1990, Max: 1999}},
+		{"year:1990..", title.YearBetweenFilter{Min: 1990}},
+		{"year:..1999", title.YearBetweenFilter{Max: 1999}},
+		{"year:0..1999", title.YearBetweenFilter{Max: 1999}},
+		{"score:70..", title.ScoreBetweenFilter{Kind: defaultScoreKind, Min: 70}},
+		{"score.imdb:7..9", title.ScoreBetweenFilter{Kind: "imdb", Min: 7, Max: 9}},
+		// keywords are case insensitive
+		{"Comedy and not Horror", title.AndFilter{Filters: []title.Filter{genre("Comedy"), title.NotFilter{Filter: genre("Horror")}}}},
+		// AND is implied between adjacent terms
+		{"Comedy Drama", title.AndFilter{Filters: []title.Filter{genre("Comedy"), genre("Drama")}}},
+		// AND binds tighter than OR
+		{"Comedy OR Drama AND Horror", title.OrFilter{Filters: []title.Filter{
+			genre("Comedy"),
+			title.AndFilter{Filters: []title.Filter{genre("Drama"), genre("Horror")}},
+		}}},
+		{"Comedy AND Drama OR Horror", title.OrFilter{Filters: []title.Filter{
+			title.AndFilter{Filters: []title.Filter{genre("Comedy"), genre("Drama")}},
+			genre("Horror"),
+		}}},
+		// NOT binds tighter than AND
+		{"NOT Comedy AND Drama", title.AndFilter{Filters: []title.Filter{title.NotFilter{Filter: genre("Comedy")}, genre("Drama")}}},
+		{"NOT NOT Comedy", title.NotFilter{Filter: title.NotFilter{Filter: genre("Comedy")}}},
+		// brackets override precedence
+		{"(Comedy OR Drama) AND Horror", title.AndFilter{Filters: []title.Filter{
+			title.OrFilter{Filters: []title.Filter{genre("Comedy"), genre("Drama")}},
+			genre("Horror"),
+		}}},
+		{"NOT (Comedy OR Drama)", title.NotFilter{Filter: title.OrFilter{Filters: []title.Filter{genre("Comedy"), genre("Drama")}}}},
+		// ON consumes every following OR name
+		{"Comedy on netflix OR prime", title.AndFilter{Filters: []title.Filter{
+			genre("Comedy"),
+			title.OnServiceFilter{Services: []string{"netflix", "prime"}},
+		}}},
+		{"(on netflix) OR Comedy", title.OrFilter{Filters: []title.Filter{
+			title.OnServiceFilter{Services: []string{"netflix"}},
+			genre("Comedy"),
+		}}},
+	}
+
+	for _, test := range tests {
+		got, err := parseExpression(test.expression)
+		if err != nil {
+			t.Errorf("parseExpression(%q) error: %s", test.expression, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseExpression(%q) = %#v, want %#v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		pos        int
+	}{
+		{"", 1},
+		{"   ", 4},
+		{`Comedy "Drama`, 8},
+		{"(Comedy", 8},
+		{"Comedy)", 7},
+		{"Comedy AND", 11},
+		{"Comedy OR OR Drama", 11},
+		{"NOT", 4},
+		{"on AND", 4},
+		{"on netflix OR", 14},
+		{"year:", 6},
+		{"year:abc", 6},
+		{"score:1..x", 7},
+		{"rating:5", 1},
+		{"Comedy AND size:5", 12},
+		// an explicit max of 0 would otherwise mean no upper bound
+		{"year:0", 6},
+		{"score:0", 7},
+		{"year:..0", 8},
+		{"score.imdb:5..0", 15},
+	}
+
+	for _, test := range tests {
+		_, err := parseExpression(test.expression)
+
+		var exprErr *expressionError
+		if !errors.As(err, &exprErr) {
+			t.Errorf("parseExpression(%q) error = %v, want an expression error", test.expression, err)
+			continue
+		}
+		if exprErr.pos != test.pos {
+			t.Errorf("parseExpression(%q) error at position %d, want %d (%s)", test.expression, exprErr.pos, test.pos, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// FacetsHandler summarises the genres, services, score kinds and years of titles in storage
+// it can be narrowed by the same filters as a random title
+func (a *API) FacetsHandler(w http.ResponseWriter, req *http.Request) {
+
+	q, err := parseTitleQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// unlike a random title, facets shouldn't leave out titles without the default score kind
+	if !hasAnyParam(req.URL.Query(), "score_kind", "score_min", "score_max") {
+		q.score.kind = ""
+	}
+
+	facets, err := a.Storage.Facets(req.Context(), q.filters()...)
+	if err != nil {
+		log.Printf("ERROR: failed to get facets from storage: %s", err)
+		http.Error(w, fmt.Sprintf("failed to get facets from storage: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(facets)
+	if err != nil {
+		log.Printf("ERROR: could not serialise facets: %s", err)
+		http.Error(w, "could not serialise facets", http.StatusInternalServerError)
+		return
+	}
+
+	addDefaultResponseHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(bytes))
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+// pageQuery is how a list of titles is paged, either by page number or (when useCursor is set) by cursor
+type pageQuery struct {
+	pageSize int
+	page     int
+
+	useCursor bool
+	// cursor is the decoded 'cursor' parameter, nil for the first page
+	cursor *pageCursor
+
+	sort []storage.SortField
+}
+
+// pageCursor is the content of an (opaque) cursor token, marking the last title on the previous page
+type pageCursor struct {
+	After string `json:"after"`
+}
+
+// titlePage is the response to a list request
+type titlePage struct {
+	Titles   []*title.Title `json:"titles"`
+	Total    int            `json:"total"`
+	Page     *int           `json:"page,omitempty"`
+	PageSize int            `json:"pageSize"`
+	Next     string         `json:"next,omitempty"`
+	Prev     string         `json:"prev,omitempty"`
+
+	// links are the RFC 5988 links to other pages, by relation type
+	links map[string]string
+}
+
+// parsePageQuery parses the pageSize, sort and either page or cursor parameters
+// cursor based paging is started by an empty cursor parameter (e.g. ?cursor=) and continued with the next link
+func parsePageQuery(values url.Values) (*pageQuery, error) {
+	var err error
+	p := &pageQuery{pageSize: defaultListPageSize}
+
+	// sort is a comma separated list of fields, each descending if prefixed with '-' e.g. -year,name
+	for _, param := range values["sort"] {
+		for _, field := range strings.Split(param, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			descending := strings.HasPrefix(field, "-")
+			p.sort = append(p.sort, storage.SortField{Field: strings.TrimLeft(field, "+-"), Descending: descending})
+		}
+	}
+
+	if pageSizeParam := values["pageSize"]; len(pageSizeParam) > 0 {
+		p.pageSize, err = strconv.Atoi(pageSizeParam[0])
+		if err != nil {
+			return nil, fmt.Errorf("pageSize query parameter must be an integer")
+		}
+		if p.pageSize < 1 {
+			return nil, fmt.Errorf("pageSize query parameter must be at least 1")
+		}
+	}
+	if p.pageSize > maxListPageSize {
+		p.pageSize = maxListPageSize
+	}
+
+	if cursorParam, ok := values["cursor"]; ok {
+		if len(values["page"]) > 0 {
+			return nil, fmt.Errorf("page and cursor query parameters can't be used together")
+		}
+		if len(p.sort) > 0 {
+			return nil, fmt.Errorf("sort and cursor query parameters can't be used together")
+		}
+		p.useCursor = true
+		if len(cursorParam) > 0 && cursorParam[0] != "" {
+			if p.cursor, err = decodeCursor(cursorParam[0]); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}
+
+	if pageParam := values["page"]; len(pageParam) > 0 {
+		p.page, err = strconv.Atoi(pageParam[0])
+		if err != nil {
+			return nil, fmt.Errorf("page query parameter must be an integer")
+		}
+		if p.page < 0 {
+			return nil, fmt.Errorf("page query parameter must not be negative")
+		}
+	}
+
+	return p, nil
+}
+
+// listOptions converts the query to options for storage, listing the titles which pass the filters
+// with a cursor, one extra title is requested to find out if there is a next page
+func (p *pageQuery) listOptions(filters []title.Filter) storage.ListOptions {
+	opts := storage.ListOptions{PageSize: p.pageSize, Page: p.page, Filters: filters, Sort: p.sort}
+	if !p.useCursor {
+		return opts
+	}
+
+	opts.PageSize++
+	opts.Page = 0
+	if p.cursor != nil {
+		opts.After = p.cursor.After
+	}
+	return opts
+}
+
+// newTitlePage builds the response for the page of titles from storage, with links relative to the request url
+func newTitlePage(u *url.URL, p *pageQuery, page *storage.TitlePage) *titlePage {
+	tp := &titlePage{
+		Titles:   page.Titles,
+		Total:    page.Total,
+		PageSize: p.pageSize,
+		links:    map[string]string{},
+	}
+
+	if p.useCursor {
+		tp.links["first"] = pageLink(u, map[string]string{"cursor": ""})
+		if len(page.Titles) > p.pageSize {
+			tp.Titles = page.Titles[:p.pageSize]
+			last := tp.Titles[len(tp.Titles)-1]
+			tp.Next = pageLink(u, map[string]string{"cursor": encodeCursor(&pageCursor{After: last.ID})})
+		}
+	} else {
+		tp.Page = &p.page
+
+		lastPage := 0
+		if page.Total > 0 {
+			lastPage = (page.Total - 1) / p.pageSize
+		}
+		tp.links["first"] = pageLink(u, map[string]string{"page": "0"})
+		tp.links["last"] = pageLink(u, map[string]string{"page": strconv.Itoa(lastPage)})
+
+		if p.page < lastPage {
+			tp.Next = pageLink(u, map[string]string{"page": strconv.Itoa(p.page + 1)})
+		}
+		if p.page > 0 {
+			tp.Prev = pageLink(u, map[string]string{"page": strconv.Itoa(min(p.page-1, lastPage))})
+		}
+	}
+
+	if tp.Next != "" {
+		tp.links["next"] = tp.Next
+	}
+	if tp.Prev != "" {
+		tp.links["prev"] = tp.Prev
+	}
+
+	return tp
+}
+
+// addLinkHeader adds the links to other pages as an RFC 5988 Link header
+func (tp *titlePage) addLinkHeader(w http.ResponseWriter) {
+	links := []string{}
+	for _, rel := range []string{"first", "prev", "next", "last"} {
+		if link, ok := tp.links[rel]; ok {
+			links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, link, rel))
+		}
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// pageLink is the (relative) url of the request, with the query parameters changed
+func pageLink(u *url.URL, params map[string]string) string {
+	query := u.Query()
+	for k, v := range params {
+		query.Set(k, v)
+	}
+
+	link := url.URL{Path: u.Path, RawQuery: query.Encode()}
+	return link.String()
+}
+
+func encodeCursor(c *pageCursor) string {
+	bytes, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeCursor(token string) (*pageCursor, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("cursor query parameter is not valid")
+	}
+
+	var c pageCursor
+	if err := json.Unmarshal(bytes, &c); err != nil || c.After == "" {
+		return nil, fmt.Errorf("cursor query parameter is not valid")
+	}
+	return &c, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
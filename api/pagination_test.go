@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+// listTitlesPage lists titles with the query, failing the test unless the response is a page
+func listTitlesPage(t *testing.T, a *API, query string) (*titlePage, http.Header) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/title?"+query, nil)
+	w := httptest.NewRecorder()
+	a.TitleHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list '%s': status = %d, want %d: %s", query, w.Code, http.StatusOK, w.Body.String())
+	}
+
+	tp := &titlePage{}
+	if err := json.Unmarshal(w.Body.Bytes(), tp); err != nil {
+		t.Fatalf("list '%s': response isn't a page: %s", query, err)
+	}
+	return tp, w.Header()
+}
+
+func pageTestAPI(t *testing.T, count int) *API {
+	a := newTestAPI(t)
+	for i := 1; i <= count; i++ {
+		addTestTitles(t, a, &title.Title{ID: fmt.Sprintf("title-%d", i), Name: fmt.Sprintf("Title %d", i)})
+	}
+	return a
+}
+
+func pageIDs(tp *titlePage) []string {
+	ids := []string{}
+	for _, t := range tp.Titles {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func TestListTitlesPages(t *testing.T) {
+	a := pageTestAPI(t, 5)
+
+	tp, header := listTitlesPage(t, a, "pageSize=2&page=1")
+	if tp.Total != 5 || tp.Page == nil || *tp.Page != 1 || tp.PageSize != 2 || len(tp.Titles) != 2 {
+		t.Errorf("page = %+v, want page 1 of 2 titles from 5", tp)
+	}
+	if tp.Next != "/title?page=2&pageSize=2" || tp.Prev != "/title?page=0&pageSize=2" {
+		t.Errorf("next = %s and prev = %s, want pages 2 and 0", tp.Next, tp.Prev)
+	}
+
+	link := strings.Join([]string{
+		`</title?page=0&pageSize=2>; rel="first"`,
+		`</title?page=0&pageSize=2>; rel="prev"`,
+		`</title?page=2&pageSize=2>; rel="next"`,
+		`</title?page=2&pageSize=2>; rel="last"`,
+	}, ", ")
+	if got := header.Get("Link"); got != link {
+		t.Errorf("Link = %s, want %s", got, link)
+	}
+
+	// past the end there is only a way back
+	tp, header = listTitlesPage(t, a, "pageSize=2&page=7")
+	if len(tp.Titles) != 0 || tp.Next != "" || tp.Prev != "/title?page=2&pageSize=2" {
+		t.Errorf("page past the end = %+v, want no titles or next and the last page as prev", tp)
+	}
+	if strings.Contains(header.Get("Link"), `rel="next"`) {
+		t.Errorf("Link = %s, want no next", header.Get("Link"))
+	}
+}
+
+func TestListTitlesCursor(t *testing.T) {
+	a := pageTestAPI(t, 5)
+
+	ids := []string{}
+	query := "pageSize=2&cursor="
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("followed %d next links, want 3 pages", pages)
+		}
+
+		tp, header := listTitlesPage(t, a, query)
+		if tp.Page != nil || tp.Prev != "" || tp.Total < 5 {
+			t.Errorf("cursor page = %+v, want no page number or prev link and a total of at least 5", tp)
+		}
+		ids = append(ids, pageIDs(tp)...)
+
+		if pages == 0 {
+			// titles are in descending id order, so a title added before the cursor doesn't shift later pages
+			addTestTitles(t, a, &title.Title{ID: "title-9"})
+		}
+
+		if tp.Next == "" {
+			if strings.Contains(header.Get("Link"), `rel="next"`) {
+				t.Errorf("Link = %s, want no next on the last page", header.Get("Link"))
+			}
+			break
+		}
+		if !strings.Contains(header.Get("Link"), fmt.Sprintf(`<%s>; rel="next"`, tp.Next)) {
+			t.Errorf("Link = %s, want next %s", header.Get("Link"), tp.Next)
+		}
+
+		next, err := url.Parse(tp.Next)
+		if err != nil {
+			t.Fatalf("next link '%s' isn't a url: %s", tp.Next, err)
+		}
+		query = next.RawQuery
+	}
+
+	want := []string{"title-5", "title-4", "title-3", "title-2", "title-1"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("paged through %v, want %v", ids, want)
+	}
+}
+
+func TestListTitlesBadPageQuery(t *testing.T) {
+	a := pageTestAPI(t, 1)
+
+	for _, query := range []string{
+		"pageSize=0",
+		"pageSize=two",
+		"page=-1",
+		"cursor=nonsense",
+		"cursor=" + encodeCursor(&pageCursor{}),
+		"cursor=&page=1",
+		"cursor=&sort=name",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/title?"+query, nil)
+		w := httptest.NewRecorder()
+		a.TitleHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("list '%s': status = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -1,24 +1,55 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
 )
 
 const (
 	defaultScoreKind = "metascore"
+	maxRandomCount   = 100
+	// matchCountHeader is the number of titles matching a random title query
+	matchCountHeader = "X-Match-Count"
+	// randomSeedHeader is the seed used to choose random titles, for seeded requests
+	randomSeedHeader = "X-Random-Seed"
 )
 
 type titleQuery struct {
-	service string
-	genres  []string
-	score   scoreQuery
+	services      []string
+	genres        []string
+	excludeGenres []string
+	score         scoreQuery
+	year          yearQuery
+	exclude       []string
+	// expression is the parsed 'q' parameter, nil if not supplied
+	expression title.Filter
+	// count is the number of distinct titles requested, 0 means a single title (not in a list)
+	count int
+	// weight biases which titles are chosen, from the 'weight' parameter
+	weight storage.Weight
+	// seed makes the titles chosen deterministic, "" means they are chosen at random
+	seed string
+}
+
+type yearQuery struct {
+	min int
+	max int
+}
+
+// randomTitleBody is the (optional) body of a POST request for a random title
+// it allows for lists which are too long to send in the query string
+type randomTitleBody struct {
+	Exclude []string `json:"exclude"`
 }
 
 type scoreQuery struct {
@@ -27,20 +58,31 @@ type scoreQuery struct {
 	max  int
 }
 
+// randomTitleCount is the response to a count request
+type randomTitleCount struct {
+	Count int `json:"count"`
+}
+
 // RandomTitleHandler handles requests for a random title
 func (a *API) RandomTitleHandler(w http.ResponseWriter, req *http.Request) {
 
-	q, err := parseTitleQuery(req.URL.Query())
+	q, err := parseRandomTitleRequest(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	title, err := a.Storage.RandomTitle(
-		title.OnServiceFilter{Service: q.service},
-		title.IsGenreFilter{Genres: q.genres},
-		title.ScoreBetweenFilter{Kind: q.score.kind, Min: q.score.min, Max: q.score.max},
-	)
+	if q.count > 0 {
+		a.randomTitles(w, req, q)
+		return
+	}
+
+	var title *title.Title
+	if q.weight.Kind == storage.Uniform && q.seed == "" {
+		title, err = a.Storage.RandomTitle(req.Context(), q.filters()...)
+	} else {
+		title, err = a.sampleTitle(req, q)
+	}
 
 	if err != nil {
 		log.Printf("ERROR: Failed to get random title from storage: %s", err)
@@ -61,28 +103,149 @@ func (a *API) RandomTitleHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	addDefaultResponseHeaders(w)
+	q.addSeedHeaders(w, req)
 	fmt.Fprint(w, string(bytes))
 	return
 }
 
+func (a *API) randomTitles(w http.ResponseWriter, req *http.Request, q *titleQuery) {
+
+	titles, err := a.Storage.SampleTitles(req.Context(), q.sampleOptions(q.count))
+	if err != nil {
+		log.Printf("ERROR: Failed to get random titles from storage: %s", err)
+		http.Error(w, "Failed to get random titles from storage", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(titles)
+	if err != nil {
+		log.Printf("ERROR: Could not serialise titles: %s", err)
+		http.Error(w, "Could not serialise titles", http.StatusInternalServerError)
+		return
+	}
+
+	addDefaultResponseHeaders(w)
+	q.addSeedHeaders(w, req)
+	fmt.Fprint(w, string(bytes))
+}
+
+func (a *API) sampleTitle(req *http.Request, q *titleQuery) (*title.Title, error) {
+	titles, err := a.Storage.SampleTitles(req.Context(), q.sampleOptions(1))
+	if err != nil || len(titles) == 0 {
+		return nil, err
+	}
+
+	return titles[0], nil
+}
+
+func (q *titleQuery) sampleOptions(count int) storage.SampleOptions {
+	return storage.SampleOptions{Count: count, Weight: q.weight, Seed: q.seed, Filters: q.filters()}
+}
+
+// addSeedHeaders returns the seed of a seeded request, and a link to the same result
+// excluded ids from the body are moved to the query string, so that a GET request for the link gets the same result
+func (q *titleQuery) addSeedHeaders(w http.ResponseWriter, req *http.Request) {
+	if q.seed == "" {
+		return
+	}
+
+	params := map[string]string{"seed": q.seed}
+	if len(q.exclude) > 0 {
+		params["exclude"] = strings.Join(q.exclude, ",")
+	}
+
+	w.Header().Set(randomSeedHeader, q.seed)
+	w.Header().Set("Content-Location", pageLink(req.URL, params))
+}
+
+// RandomTitleCountHandler counts the titles a random title would be chosen from, without choosing one
+// the count is also returned in the X-Match-Count header
+func (a *API) RandomTitleCountHandler(w http.ResponseWriter, req *http.Request) {
+
+	q, err := parseRandomTitleRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count, err := a.Storage.CountTitles(req.Context(), q.filters()...)
+	if err != nil {
+		log.Printf("ERROR: Failed to count titles in storage: %s", err)
+		http.Error(w, "Failed to count titles in storage", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(randomTitleCount{Count: count})
+	if err != nil {
+		log.Printf("ERROR: Could not serialise count: %s", err)
+		http.Error(w, "Could not serialise count", http.StatusInternalServerError)
+		return
+	}
+
+	addDefaultResponseHeaders(w)
+	w.Header().Set(matchCountHeader, strconv.Itoa(count))
+	fmt.Fprint(w, string(bytes))
+}
+
+// parseRandomTitleRequest parses the query, and for a POST request the (optional) body
+func parseRandomTitleRequest(req *http.Request) (*titleQuery, error) {
+
+	q, err := parseTitleQuery(req.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodPost {
+		defer req.Body.Close()
+
+		var body randomTitleBody
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not parse body: %s", err)
+		}
+		q.exclude = append(q.exclude, body.Exclude...)
+	}
+
+	return q, nil
+}
+
+// filters converts the query to title filters, to be passed to storage
+func (q *titleQuery) filters() []title.Filter {
+	filters := []title.Filter{
+		title.OnServiceFilter{Services: q.services},
+		title.IsGenreFilter{Genres: q.genres},
+		title.ExcludeGenresFilter{Genres: q.excludeGenres},
+		title.ScoreBetweenFilter{Kind: q.score.kind, Min: q.score.min, Max: q.score.max},
+		title.YearBetweenFilter{Min: q.year.min, Max: q.year.max},
+		title.ExcludeIDsFilter{IDs: q.exclude},
+	}
+	if q.expression != nil {
+		filters = append(filters, q.expression)
+	}
+
+	return filters
+}
+
 func parseTitleQuery(query map[string][]string) (*titleQuery, error) {
 
 	tq := &titleQuery{}
 	var err error
 
-	// Service
-	keys, ok := query["service"]
-	if ok && len(keys) > 0 {
-		tq.service = keys[0]
+	// Services (any of), either comma separated or repeated
+	for _, key := range query["service"] {
+		tq.services = append(tq.services, strings.Split(key, ",")...)
 	}
 
 	// Genres
 	if len(query["genres"]) > 0 {
 		tq.genres = strings.Split(query["genres"][0], ",")
 	}
+	if len(query["exclude_genres"]) > 0 {
+		tq.excludeGenres = strings.Split(query["exclude_genres"][0], ",")
+	}
 
 	// Score
-	keys, ok = query["score_kind"]
+	keys, ok := query["score_kind"]
 	if ok && len(keys) > 0 {
 		tq.score.kind = keys[0]
 	} else {
@@ -103,5 +266,98 @@ func parseTitleQuery(query map[string][]string) (*titleQuery, error) {
 		}
 	}
 
+	// Year
+	keys, ok = query["year_min"]
+	if ok && len(keys) > 0 {
+		tq.year.min, err = strconv.Atoi(keys[0])
+		if err != nil {
+			return nil, fmt.Errorf("year_min query parameter must be an integer")
+		}
+	}
+	keys, ok = query["year_max"]
+	if ok && len(keys) > 0 {
+		tq.year.max, err = strconv.Atoi(keys[0])
+		if err != nil {
+			return nil, fmt.Errorf("year_max query parameter must be an integer")
+		}
+	}
+
+	// Exclude
+	if len(query["exclude"]) > 0 {
+		for _, id := range strings.Split(query["exclude"][0], ",") {
+			if id != "" {
+				tq.exclude = append(tq.exclude, id)
+			}
+		}
+	}
+
+	// Expression
+	keys, ok = query["q"]
+	if ok && len(keys) > 0 && strings.TrimSpace(keys[0]) != "" {
+		tq.expression, err = parseExpression(keys[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Count
+	keys, ok = query["count"]
+	if ok && len(keys) > 0 {
+		tq.count, err = strconv.Atoi(keys[0])
+		if err != nil || tq.count < 1 {
+			return nil, fmt.Errorf("count query parameter must be a positive integer")
+		}
+		if tq.count > maxRandomCount {
+			tq.count = maxRandomCount
+		}
+	}
+
+	// Weight, either 'uniform' (the default), 'recency', 'score' (by score_kind) or 'score:<kind>'
+	keys, ok = query["weight"]
+	if ok && len(keys) > 0 {
+		tq.weight, err = parseWeight(keys[0], tq.score.kind)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Seed, where an empty seed (e.g. ?seed=) asks for a new seed to be chosen, so that the result can be shared
+	keys, ok = query["seed"]
+	if ok {
+		if len(keys) > 0 && keys[0] != "" {
+			tq.seed = keys[0]
+		} else {
+			tq.seed, err = newSeed()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return tq, nil
 }
+
+// newSeed chooses a short, random seed
+// crypto/rand is used, as math/rand isn't seeded, so would choose the same seeds every time the api starts
+func newSeed() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not choose a seed: %s", err)
+	}
+	return strconv.FormatUint(binary.BigEndian.Uint64(b), 36), nil
+}
+
+func parseWeight(weight string, scoreKind string) (storage.Weight, error) {
+	switch {
+	case weight == "" || weight == "uniform":
+		return storage.Weight{Kind: storage.Uniform}, nil
+	case weight == "recency":
+		return storage.Weight{Kind: storage.RecencyWeight}, nil
+	case weight == "score" && scoreKind != "":
+		return storage.Weight{Kind: storage.ScoreWeight, ScoreKind: scoreKind}, nil
+	case strings.HasPrefix(weight, "score:") && weight != "score:":
+		return storage.Weight{Kind: storage.ScoreWeight, ScoreKind: strings.TrimPrefix(weight, "score:")}, nil
+	default:
+		return storage.Weight{}, fmt.Errorf("weight query parameter must be one of 'uniform', 'recency', 'score' or 'score:<kind>'")
+	}
+}
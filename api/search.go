@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchTitlesHandler finds titles by name and description, best match first
+// the last word of q matches the start of words, so it can be used for autocomplete
+func (a *API) SearchTitlesHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		http.Error(w, "q query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if limitParam := query["limit"]; len(limitParam) > 0 {
+		var err error
+		limit, err = strconv.Atoi(limitParam[0])
+		if err != nil || limit < 1 {
+			http.Error(w, "limit query parameter must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	titles, err := a.Storage.SearchTitles(req.Context(), q, limit)
+	if err != nil {
+		log.Printf("ERROR: failed to search titles in storage: %s", err)
+		http.Error(w, fmt.Sprintf("failed to search titles in storage: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(titles)
+	if err != nil {
+		log.Printf("ERROR: could not serialise titles: %s", err)
+		http.Error(w, "could not serialise titles", http.StatusInternalServerError)
+		return
+	}
+
+	addDefaultResponseHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(bytes))
+}
@@ -2,28 +2,42 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
-	"strconv"
+	"net/url"
 
 	"github.com/gorilla/mux"
 	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
 )
 
 const (
 	defaultListPageSize = 100
 	maxListPageSize     = 1000
+
+	mergePatchContentType = "application/merge-patch+json"
 )
 
 // TitleHandler handles requests on the CRUD title endpoint
 func (a *API) TitleHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		// the titles of the day depend on the titles in storage, so may change with any write
+		defer a.daily.clear()
+	}
+
 	switch req.Method {
 	case http.MethodPost:
 		a.createTitle(w, req)
 	case http.MethodPut:
 		a.updateTitle(w, req)
+	case http.MethodPatch:
+		a.patchTitle(w, req)
+	case http.MethodDelete:
+		a.deleteTitle(w, req)
 	case http.MethodGet:
 		if mux.Vars(req)["id"] != "" {
 			a.getTitle(w, req)
@@ -37,37 +51,38 @@ func (a *API) TitleHandler(w http.ResponseWriter, req *http.Request) {
 
 func (a *API) listTitles(w http.ResponseWriter, req *http.Request) {
 
-	var err error
-	pageSize := defaultListPageSize
-	page := 0
-
-	if pageSizeParam := req.URL.Query()["pageSize"]; pageSizeParam != nil && len(pageSizeParam) > 0 {
-		pageSize, err = strconv.Atoi(pageSizeParam[0])
-		if err != nil {
-			http.Error(w, "pageSize query parameter must be an integer", http.StatusBadRequest)
-			return
-		}
+	p, err := parsePageQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if pageParam := req.URL.Query()["page"]; pageParam != nil && len(pageParam) > 0 {
-		page, err = strconv.Atoi(pageParam[0])
-		if err != nil {
-			http.Error(w, "page query parameter must be an integer", http.StatusBadRequest)
-			return
-		}
+	// the same filters as for a random title
+	q, err := parseTitleQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// unlike a random title, listing shouldn't hide titles without the default score kind
+	if !hasAnyParam(req.URL.Query(), "score_kind", "score_min", "score_max") {
+		q.score.kind = ""
 	}
 
-	if pageSize > maxListPageSize {
-		pageSize = maxListPageSize
+	opts := p.listOptions(q.filters())
+	if err := opts.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	titles, err := a.Storage.ListTitles(pageSize, page)
+	page, err := a.Storage.ListTitles(req.Context(), opts)
 	if err != nil {
 		log.Printf("ERROR: failed to get titles from storage: %s", err)
 		http.Error(w, fmt.Sprintf("failed to get titles from storage: %s", err), http.StatusInternalServerError)
 		return
 	}
 
-	bytes, err := json.Marshal(titles)
+	tp := newTitlePage(req.URL, p, page)
+
+	bytes, err := json.Marshal(tp)
 	if err != nil {
 		log.Printf("ERROR: could not serialise titles: %s", err)
 		http.Error(w, "could not serialise titles", http.StatusInternalServerError)
@@ -75,6 +90,7 @@ func (a *API) listTitles(w http.ResponseWriter, req *http.Request) {
 	}
 
 	addDefaultResponseHeaders(w)
+	tp.addLinkHeader(w)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, string(bytes))
 }
@@ -86,7 +102,7 @@ func (a *API) getTitle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	title, err := a.Storage.GetTitle(id)
+	title, err := a.Storage.GetTitle(req.Context(), id)
 	if err != nil {
 		log.Printf("ERROR: failed to get title from storage: %s", err)
 		http.Error(w, fmt.Sprintf("failed to get title from storage: %s", err), http.StatusInternalServerError)
@@ -97,6 +113,12 @@ func (a *API) getTitle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", titleETag(title))
+	if !noneMatch(req, title) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	bytes, err := json.Marshal(title)
 	if err != nil {
 		log.Printf("ERROR: could not serialise title: %s", err)
@@ -118,21 +140,9 @@ func (a *API) createTitle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	t, err := a.Storage.GetTitle(title.ID)
+	t, err := a.Storage.AddTitle(req.Context(), title)
 	if err != nil {
-		log.Printf("ERROR: failed to get title from storage: %s", err)
-		http.Error(w, fmt.Sprintf("failed to get title from storage: %s", err), http.StatusInternalServerError)
-		return
-	}
-	if t != nil {
-		http.Error(w, fmt.Sprintf("title with id '%s' already exists", title.ID), http.StatusConflict)
-		return
-	}
-
-	t, err = a.Storage.AddTitle(title)
-	if err != nil {
-		log.Printf("ERROR: failed to add title to storage: %s", err)
-		http.Error(w, fmt.Sprintf("failed to add title to storage: %s", err), http.StatusInternalServerError)
+		writeStorageError(w, "add title to storage", err)
 		return
 	}
 
@@ -144,6 +154,7 @@ func (a *API) createTitle(w http.ResponseWriter, req *http.Request) {
 	}
 
 	addDefaultResponseHeaders(w)
+	w.Header().Set("ETag", titleETag(t))
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprint(w, string(bytes))
 }
@@ -157,36 +168,103 @@ func (a *API) updateTitle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	t, err := a.Storage.GetTitle(id)
+	title := parseTitleFromBody(req)
+	if title == nil {
+		http.Error(w, "could not parse body to title", http.StatusBadRequest)
+		return
+	}
+	if id != title.ID {
+		http.Error(w, fmt.Sprintf("id mismatch between body (%s) and url (%s)", title.ID, id), http.StatusBadRequest)
+		return
+	}
+
+	revision, ok := a.checkIfMatch(w, req, id)
+	if !ok {
+		return
+	}
+
+	t, err := a.Storage.UpdateTitle(req.Context(), title, revision)
 	if err != nil {
-		log.Printf("ERROR: failed to get title from storage: %s", err)
-		http.Error(w, fmt.Sprintf("failed to get title to storage: %s", err), http.StatusInternalServerError)
+		writeConditionalStorageError(w, "update title in storage", err, revision)
 		return
 	}
-	if t == nil {
-		http.Error(w, fmt.Sprintf("title with id '%s' does not exist", id), http.StatusNotFound)
+
+	addDefaultResponseHeaders(w)
+	w.Header().Set("ETag", titleETag(t))
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchTitle applies a JSON merge patch (RFC 7396) to the title, only changing the fields in the patch
+func (a *API) patchTitle(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	id := (mux.Vars(req))["id"]
+	if id == "" {
+		http.Error(w, "no title id supplied in url", http.StatusBadRequest)
 		return
 	}
 
-	title := parseTitleFromBody(req)
-	if title == nil {
-		http.Error(w, "could not parse body to title", http.StatusBadRequest)
+	if !hasContentType(req, mergePatchContentType, "application/json") {
+		http.Error(w, fmt.Sprintf("content type must be %s", mergePatchContentType), http.StatusUnsupportedMediaType)
 		return
 	}
-	if id != title.ID {
-		http.Error(w, fmt.Sprintf("id mismatch between body (%s) and url (%s)", title.ID, id), http.StatusBadRequest)
+
+	patch, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf("ERROR: could not read request body: %s", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
 		return
 	}
 
-	_, err = a.Storage.UpdateTitle(title)
+	// check the patch is valid before going to storage, so that bad patches aren't reported as storage errors
+	patched, err := title.MergePatch(&title.Title{ID: id}, patch)
 	if err != nil {
-		log.Printf("ERROR: failed to update title in storage: %s", err)
-		http.Error(w, fmt.Sprintf("failed to update title in storage: %s", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if patched.ID != id {
+		http.Error(w, fmt.Sprintf("id mismatch between patch (%s) and url (%s)", patched.ID, id), http.StatusBadRequest)
+		return
+	}
+
+	revision, ok := a.checkIfMatch(w, req, id)
+	if !ok {
+		return
+	}
+
+	t, err := a.Storage.PatchTitle(req.Context(), id, patch, revision)
+	if err != nil {
+		writeConditionalStorageError(w, "patch title in storage", err, revision)
+		return
+	}
+
+	bytes, err := json.Marshal(t)
+	if err != nil {
+		log.Printf("ERROR: could not serialise title: %s", err)
+		http.Error(w, "could not serialise title", http.StatusInternalServerError)
 		return
 	}
 
 	addDefaultResponseHeaders(w)
+	w.Header().Set("ETag", titleETag(t))
 	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(bytes))
+}
+
+func (a *API) deleteTitle(w http.ResponseWriter, req *http.Request) {
+	id := (mux.Vars(req))["id"]
+	if id == "" {
+		http.Error(w, "no title id supplied in url", http.StatusBadRequest)
+		return
+	}
+
+	err := a.Storage.DeleteTitle(req.Context(), id)
+	if err != nil {
+		writeStorageError(w, "delete title from storage", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func parseTitleFromBody(req *http.Request) *title.Title {
@@ -206,6 +284,49 @@ func parseTitleFromBody(req *http.Request) *title.Title {
 	return &title
 }
 
+// writeStorageError writes the error from storage with the matching status code
+// action describes what failed e.g. "add title to storage"
+func writeStorageError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrAlreadyExists), errors.Is(err, storage.ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("ERROR: failed to %s: %s", action, err)
+		http.Error(w, fmt.Sprintf("failed to %s: %s", action, err), http.StatusInternalServerError)
+	}
+}
+
+// hasAnyParam checks if any of the query parameters are set
+func hasAnyParam(values url.Values, keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := values[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasContentType checks the request body is one of the media types, a request without a Content-Type is allowed
+func hasContentType(req *http.Request, mediaTypes ...string) bool {
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, m := range mediaTypes {
+		if mediaType == m {
+			return true
+		}
+	}
+	return false
+}
+
 func addDefaultResponseHeaders(w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "application/json")
 }
@@ -16,8 +16,11 @@ type Config struct {
 	Port               int      `default:"8080"`
 	StorageKind        string   `default:"MemStore"`
 	CorsAllowedOrigins []string `default:"*"`
-	CorsAllowedHeaders []string `default:"Content-Type"`
-	CorsAllowedMethods []string `default:"GET,OPTIONS"`
+	CorsAllowedHeaders []string `default:"Content-Type,If-Match,If-None-Match"`
+	CorsAllowedMethods []string `default:"GET,POST,PATCH,DELETE,OPTIONS"`
+	CorsExposedHeaders []string `default:"ETag,X-Match-Count,X-Random-Seed,Content-Location"`
+	DailyNoRepeatDays  int      `default:"30"`
+	RequireIfMatch     bool     `default:"false"`
 }
 
 func (c *Config) String() string {
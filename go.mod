@@ -3,9 +3,10 @@ module github.com/microhod/randflix-api
 go 1.15
 
 require (
-	github.com/gobeam/mongo-go-pagination v0.0.2
 	github.com/gorilla/mux v1.8.0
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/lib/pq v1.10.0
 	github.com/rs/cors v1.7.0
+	go.etcd.io/bbolt v1.3.6
 	go.mongodb.org/mongo-driver v1.5.1
 )
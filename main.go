@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	"github.com/microhod/randflix-api/api"
@@ -15,36 +19,66 @@ import (
 )
 
 func main() {
+	if err := run(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+}
+
+// run serves the api until it's shut down, errors are returned (rather than exiting) so that storage is disconnected
+func run() error {
 
 	cfg, err := config.GetConfig()
 	if err != nil {
-		log.Fatalf("failed to get config: %s\n", err)
+		return fmt.Errorf("failed to get config: %s", err)
 	}
 	log.Printf("config: %s\n", cfg)
 
 	store, err := storage.CreateStorage(cfg)
 	if err != nil {
-		log.Fatalf("failed to create storage: %s\n", err)
+		return fmt.Errorf("failed to create storage: %s", err)
 	}
 
-	api := api.API{Storage: store}
+	api := api.API{
+		Storage:           store,
+		DailyNoRepeatDays: cfg.DailyNoRepeatDays,
+		RequireIfMatch:    cfg.RequireIfMatch,
+	}
 	defer store.Disconnect()
 
 	r := mux.NewRouter()
 	r.HandleFunc("/title/random", api.RandomTitleHandler).
+		Methods(http.MethodGet, http.MethodPost).
+		Schemes("http")
+	r.HandleFunc("/title/random/count", api.RandomTitleCountHandler).
+		Methods(http.MethodGet, http.MethodPost).
+		Schemes("http")
+	r.HandleFunc("/title/daily", api.DailyTitleHandler).
+		Methods(http.MethodGet).
+		Schemes("http")
+	r.HandleFunc("/title/search", api.SearchTitlesHandler).
 		Methods(http.MethodGet).
 		Schemes("http")
 	r.HandleFunc("/title", api.TitleHandler).
 		Methods(http.MethodPost, http.MethodGet).
 		Schemes("http")
+	r.HandleFunc("/titles:bulk", api.BulkTitlesHandler).
+		Methods(http.MethodPost).
+		Schemes("http")
+	r.HandleFunc("/titles:export", api.ExportTitlesHandler).
+		Methods(http.MethodGet).
+		Schemes("http")
+	r.HandleFunc("/facets", api.FacetsHandler).
+		Methods(http.MethodGet).
+		Schemes("http")
 	r.HandleFunc("/title/{id}", api.TitleHandler).
-		Methods(http.MethodGet, http.MethodPut).
+		Methods(http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete).
 		Schemes("http")
 
 	cors := cors.New(cors.Options{
 		AllowedOrigins: cfg.CorsAllowedOrigins,
 		AllowedHeaders: cfg.CorsAllowedHeaders,
 		AllowedMethods: cfg.CorsAllowedMethods,
+		ExposedHeaders: cfg.CorsExposedHeaders,
 	})
 
 	handler := cors.Handler(r)
@@ -53,10 +87,40 @@ func main() {
 	if port, ok := os.LookupEnv("FUNCTIONS_CUSTOMHANDLER_PORT"); ok {
 		cfg.Port, err = strconv.Atoi(port)
 		if err != nil {
-			log.Fatalf("failed to parse FUNCTIONS_CUSTOMHANDLER_PORT to int: %s", err)
+			return fmt.Errorf("failed to parse FUNCTIONS_CUSTOMHANDLER_PORT to int: %s", err)
 		}
 	}
 
+	// cancelling the base context cancels every in-flight request (and so storage operation) on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        fmt.Sprintf("0.0.0.0:%d", cfg.Port),
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	// done is closed once shutdown has finished, so that storage isn't disconnected under in-flight requests
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Printf("(http): shutting down http server")
+		cancel()
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("ERROR: failed to shut down http server: %s", err)
+		}
+	}()
+
 	log.Printf("(http): starting http server on port %d", cfg.Port)
-	http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", cfg.Port), handler)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("failed to start http server: %s", err)
+	}
+	// ListenAndServe returns as soon as shutdown starts
+	<-done
+
+	return nil
 }
@@ -3,10 +3,10 @@ package title
 // Filter is a generic filter interface
 type Filter interface{}
 
-// OnServiceFilter checks if the title is on the specified service e.g. Netflix
-// if service is an empty string, it has no effect
+// OnServiceFilter checks if the title is on any of the specified services e.g. Netflix
+// empty service names are ignored, if there are no services it has no effect
 type OnServiceFilter struct {
-	Service string
+	Services []string
 }
 
 // IsGenreFilter checks if the title is of the specified genres (case insensitive)
@@ -14,9 +14,45 @@ type IsGenreFilter struct {
 	Genres []string
 }
 
+// ExcludeGenresFilter checks that the title is none of the specified genres (case insensitive)
+// if there are no genres, it has no effect
+type ExcludeGenresFilter struct {
+	Genres []string
+}
+
 // ScoreBetweenFilter checks if the title has the specified score in the specified range
 type ScoreBetweenFilter struct {
 	Kind string
 	Min  int
 	Max  int
 }
+
+// YearBetweenFilter checks if the title was released in the specified range of years (inclusive)
+// if max is 0, there is no upper bound. If both min and max are 0, it has no effect
+type YearBetweenFilter struct {
+	Min int
+	Max int
+}
+
+// ExcludeIDsFilter checks that the title is not one of the specified ids
+// if ids is empty, it has no effect
+type ExcludeIDsFilter struct {
+	IDs []string
+}
+
+// AndFilter checks that the title passes all of the filters
+// if there are no filters, it has no effect
+type AndFilter struct {
+	Filters []Filter
+}
+
+// OrFilter checks that the title passes at least one of the filters
+// if there are no filters, it has no effect
+type OrFilter struct {
+	Filters []Filter
+}
+
+// NotFilter checks that the title does not pass the filter
+type NotFilter struct {
+	Filter Filter
+}
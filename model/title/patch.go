@@ -0,0 +1,71 @@
+package title
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// MergePatch applies a JSON merge patch (RFC 7396) to the title, returning the patched copy
+// the original title is left unchanged
+func MergePatch(t *Title, patch []byte) (*Title, error) {
+	var p interface{}
+	if err := decodeJSON(patch, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse merge patch: %s", err)
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("merge patch must be a JSON object")
+	}
+
+	original, err := json.Marshal(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal title: %s", err)
+	}
+	var target interface{}
+	if err := decodeJSON(original, &target); err != nil {
+		return nil, fmt.Errorf("failed to parse title: %s", err)
+	}
+
+	merged, err := json.Marshal(mergePatch(target, p))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal patched title: %s", err)
+	}
+
+	var patched Title
+	decoder := json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patched); err != nil {
+		return nil, fmt.Errorf("patched title is not valid: %s", err)
+	}
+
+	return &patched, nil
+}
+
+// mergePatch is the MergePatch function from RFC 7396
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+
+	return t
+}
+
+// decodeJSON decodes, keeping numbers as they were written (rather than converting to float64)
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
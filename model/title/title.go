@@ -11,6 +11,7 @@ type Title struct {
 	Poster      string                `json:"poster"`
 	Directories map[string]*Directory `json:"directories"`
 	Services    map[string]*Service   `json:"services"`
+	Revision    int                   `json:"revision"` // incremented by storage every time the title is written
 }
 
 // Directory is a reference to a title in an external store such as IMDB
@@ -0,0 +1,13 @@
+package storage
+
+import "errors"
+
+// Errors returned by every Storage implementation (possibly wrapped), check for them with errors.Is
+var (
+	// ErrNotFound is returned when the title to be changed does not exist
+	ErrNotFound = errors.New("title does not exist")
+	// ErrAlreadyExists is returned when adding a title with the same id as an existing title
+	ErrAlreadyExists = errors.New("title already exists")
+	// ErrConflict is returned when a change conflicts with the current state of the title
+	ErrConflict = errors.New("title has been modified")
+)
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+// Facets summarise the values of titles in storage, with the number of titles having each value
+type Facets struct {
+	// Total is the number of titles summarised
+	Total int `json:"total"`
+	// Genres are lower case, as genre filters are case insensitive
+	Genres     []FacetCount `json:"genres"`
+	Services   []FacetCount `json:"services"`
+	ScoreKinds []FacetCount `json:"scoreKinds"`
+	Years      YearRange    `json:"years"`
+}
+
+// FacetCount is the number of titles with a value, facet counts are ordered by the most titles first
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// YearRange is the range of years titles were released in
+// titles without a year (i.e. 0) are left out, so Count is the number of titles with a year
+type YearRange struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"`
+	Count int `json:"count"`
+}
+
+// facetCounts converts counts of each value to facet counts, most titles first then by value
+func facetCounts(counts map[string]int) []FacetCount {
+	facets := []FacetCount{}
+	for value, count := range counts {
+		facets = append(facets, FacetCount{Value: value, Count: count})
+	}
+
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Value < facets[j].Value
+	})
+	return facets
+}
+
+// haveNoEffect checks if every filter passes every title, i.e. the filters don't narrow anything down
+func haveNoEffect(filters []title.Filter) bool {
+	for _, tf := range filters {
+		if !hasNoEffect(tf) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasNoEffect checks if a filter passes every title, e.g. a genre filter without any genres
+func hasNoEffect(tf title.Filter) bool {
+	switch f := tf.(type) {
+	case title.OnServiceFilter:
+		return len(nonEmpty(f.Services)) == 0
+	case title.IsGenreFilter:
+		return len(f.Genres) == 0
+	case title.ExcludeGenresFilter:
+		return len(nonEmpty(f.Genres)) == 0
+	case title.ScoreBetweenFilter:
+		return f.Kind == ""
+	case title.YearBetweenFilter:
+		return f.Min == 0 && f.Max == 0
+	case title.ExcludeIDsFilter:
+		return len(f.IDs) == 0
+	case title.AndFilter:
+		return len(f.Filters) == 0
+	case title.OrFilter:
+		return len(f.Filters) == 0
+	default:
+		return false
+	}
+}
+
+// facetIndex counts the titles with each facet value
+// note: it isn't safe for concurrent use, MemStore only uses it while holding its lock
+type facetIndex struct {
+	total      int
+	genres     map[string]int
+	services   map[string]int
+	scoreKinds map[string]int
+	years      map[int]int
+}
+
+func newFacetIndex() *facetIndex {
+	return &facetIndex{
+		genres:     map[string]int{},
+		services:   map[string]int{},
+		scoreKinds: map[string]int{},
+		years:      map[int]int{},
+	}
+}
+
+// add counts the title's values
+func (i *facetIndex) add(t *title.Title) {
+	i.count(t, 1)
+}
+
+// remove uncounts the title's values, it must be the same as the title which was added
+func (i *facetIndex) remove(t *title.Title) {
+	i.count(t, -1)
+}
+
+func (i *facetIndex) count(t *title.Title, delta int) {
+	i.total += delta
+
+	genres := map[string]bool{}
+	for _, g := range t.Genres {
+		genres[strings.ToLower(g)] = true
+	}
+	for g := range genres {
+		countValue(i.genres, g, delta)
+	}
+	// the same as the service filter, a title is only on a service with a url
+	for name, s := range t.Services {
+		if s != nil && s.URL != "" {
+			countValue(i.services, name, delta)
+		}
+	}
+	for kind := range t.Scores {
+		countValue(i.scoreKinds, kind, delta)
+	}
+
+	if t.Year != 0 {
+		i.years[t.Year] += delta
+		if i.years[t.Year] == 0 {
+			delete(i.years, t.Year)
+		}
+	}
+}
+
+func countValue(counts map[string]int, value string, delta int) {
+	counts[value] += delta
+	if counts[value] == 0 {
+		delete(counts, value)
+	}
+}
+
+func (i *facetIndex) facets() *Facets {
+	f := &Facets{
+		Total:      i.total,
+		Genres:     facetCounts(i.genres),
+		Services:   facetCounts(i.services),
+		ScoreKinds: facetCounts(i.scoreKinds),
+	}
+
+	for year, count := range i.years {
+		if f.Years.Count == 0 || year < f.Years.Min {
+			f.Years.Min = year
+		}
+		if f.Years.Count == 0 || year > f.Years.Max {
+			f.Years.Max = year
+		}
+		f.Years.Count += count
+	}
+
+	return f
+}
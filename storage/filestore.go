@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+var (
+	titlesBucket = []byte("titles")
+)
+
+// FileStore is storage persisted to a single embedded (bolt) database file
+// all titles are also held in memory, so reads (and filtering) behave exactly like MemStore
+type FileStore struct {
+	lock   sync.Mutex
+	db     *bolt.DB
+	cache  *MemStore
+	config *fileConfig
+}
+
+type fileConfig struct {
+	Path        string        `default:"randflix.db"`
+	OpenTimeout time.Duration `default:"10s"`
+}
+
+func (c *fileConfig) String() string {
+	s, _ := json.MarshalIndent(c, "", "\t")
+	return string(s)
+}
+
+// NewFileStore opens (or creates) the database file specified in the config
+func (c *Config) NewFileStore() (Storage, error) {
+
+	var fConfig fileConfig
+	err := c.ProcessStorageConfig(&fConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file store config: %s", err)
+	}
+	fc := &fConfig
+
+	log.Printf("file store config: %s\n", fc.String())
+
+	db, err := bolt.Open(fc.Path, 0600, &bolt.Options{Timeout: fc.OpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database file '%s': %s", fc.Path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(titlesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create titles bucket: %s", err)
+	}
+
+	f := &FileStore{
+		db:     db,
+		cache:  newMemStore(),
+		config: fc,
+	}
+
+	if err := f.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load titles from '%s': %s", fc.Path, err)
+	}
+	log.Printf("(storage): loaded %d titles from %s", len(f.cache.titles), fc.Path)
+
+	return f, nil
+}
+
+// load reads every title from the database file into the in memory cache
+func (f *FileStore) load() error {
+	return f.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(titlesBucket).ForEach(func(k, v []byte) error {
+			var t *title.Title
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("failed to unmarshal title '%s': %s", k, err)
+			}
+			f.cache.store(t)
+			return nil
+		})
+	})
+}
+
+// Disconnect closes the database file
+func (f *FileStore) Disconnect() {
+	if err := f.db.Close(); err != nil {
+		log.Printf("ERROR: failed to close database file '%s': %s", f.config.Path, err)
+	}
+}
+
+// RandomTitle chooses a random title from storage (filtered by the filters)
+func (f *FileStore) RandomTitle(ctx context.Context, filters ...title.Filter) (*title.Title, error) {
+	return f.cache.RandomTitle(ctx, filters...)
+}
+
+// RandomTitles chooses up to count distinct random titles from storage (filtered by the filters)
+func (f *FileStore) RandomTitles(ctx context.Context, count int, filters ...title.Filter) ([]*title.Title, error) {
+	return f.cache.RandomTitles(ctx, count, filters...)
+}
+
+// SampleTitles chooses up to opts.Count distinct titles, with probability proportional to their weight
+func (f *FileStore) SampleTitles(ctx context.Context, opts SampleOptions) ([]*title.Title, error) {
+	return f.cache.SampleTitles(ctx, opts)
+}
+
+// AddTitle adds the title to storage
+func (f *FileStore) AddTitle(ctx context.Context, t *title.Title) (*title.Title, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if existing, _ := f.cache.GetTitle(ctx, t.ID); existing != nil {
+		return nil, fmt.Errorf("%w with id: '%s'", ErrAlreadyExists, t.ID)
+	}
+
+	added := withRevision(t, 1)
+	if err := f.put(ctx, added); err != nil {
+		return nil, err
+	}
+
+	f.cache.set(added)
+	return added, nil
+}
+
+// UpdateTitle replaces the title in storage
+func (f *FileStore) UpdateTitle(ctx context.Context, t *title.Title, revision int) (*title.Title, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	existing, _ := f.cache.GetTitle(ctx, t.ID)
+	if existing == nil {
+		return nil, fmt.Errorf("%w with id: '%s'", ErrNotFound, t.ID)
+	}
+	if err := checkRevision(existing, revision); err != nil {
+		return nil, err
+	}
+
+	updated := withRevision(t, existing.Revision+1)
+	if err := f.put(ctx, updated); err != nil {
+		return nil, err
+	}
+
+	f.cache.set(updated)
+	return updated, nil
+}
+
+// PatchTitle applies the merge patch to the title in storage
+func (f *FileStore) PatchTitle(ctx context.Context, id string, patch []byte, revision int) (*title.Title, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	existing, _ := f.cache.GetTitle(ctx, id)
+	if existing == nil {
+		return nil, fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
+	if err := checkRevision(existing, revision); err != nil {
+		return nil, err
+	}
+
+	patched, err := applyPatch(existing, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	patched = withRevision(patched, existing.Revision+1)
+	if err := f.put(ctx, patched); err != nil {
+		return nil, err
+	}
+
+	f.cache.set(patched)
+	return patched, nil
+}
+
+// BulkUpsert writes all the titles in a single database transaction
+func (f *FileStore) BulkUpsert(ctx context.Context, titles []*title.Title, mode BulkMode) ([]BulkResult, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	results := bulkResults(titles, mode, func(id string) *title.Title {
+		t, _ := f.cache.GetTitle(ctx, id)
+		return t
+	})
+
+	// bolt transactions can't be cancelled, so check before starting one
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(titlesBucket)
+		for _, r := range results {
+			if r.Err != nil {
+				continue
+			}
+
+			bytes, err := json.Marshal(r.Title)
+			if err != nil {
+				return fmt.Errorf("failed to marshal title '%s': %s", r.Title.ID, err)
+			}
+			if err := bucket.Put([]byte(r.Title.ID), bytes); err != nil {
+				return fmt.Errorf("failed to write title '%s' to database file: %s", r.Title.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range results {
+		if r.Err == nil {
+			f.cache.set(r.Title)
+		}
+	}
+
+	return results, nil
+}
+
+// GetTitle retrieves a title from storage by id
+func (f *FileStore) GetTitle(ctx context.Context, id string) (*title.Title, error) {
+	return f.cache.GetTitle(ctx, id)
+}
+
+// DeleteTitle removes a title from storage by id
+func (f *FileStore) DeleteTitle(ctx context.Context, id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if existing, _ := f.cache.GetTitle(ctx, id); existing == nil {
+		return fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(titlesBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete title '%s' from database file: %s", id, err)
+	}
+
+	return f.cache.DeleteTitle(ctx, id)
+}
+
+// ListTitles retrieves a page of titles from storage
+func (f *FileStore) ListTitles(ctx context.Context, opts ListOptions) (*TitlePage, error) {
+	return f.cache.ListTitles(ctx, opts)
+}
+
+// SearchTitles finds up to limit titles matching the query
+func (f *FileStore) SearchTitles(ctx context.Context, query string, limit int) ([]*title.Title, error) {
+	return f.cache.SearchTitles(ctx, query, limit)
+}
+
+// CountTitles counts the titles passing the filters
+func (f *FileStore) CountTitles(ctx context.Context, filters ...title.Filter) (int, error) {
+	return f.cache.CountTitles(ctx, filters...)
+}
+
+// Facets summarises the titles passing the filters
+func (f *FileStore) Facets(ctx context.Context, filters ...title.Filter) (*Facets, error) {
+	return f.cache.Facets(ctx, filters...)
+}
+
+// EachTitle calls fn with every title in storage
+func (f *FileStore) EachTitle(ctx context.Context, fn func(t *title.Title) error) error {
+	return f.cache.EachTitle(ctx, fn)
+}
+
+func (f *FileStore) put(ctx context.Context, t *title.Title) error {
+	// bolt transactions can't be cancelled, so check before starting one
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to marshal title '%s': %s", t.ID, err)
+	}
+
+	err = f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(titlesBucket).Put([]byte(t.ID), bytes)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write title '%s' to database file: %s", t.ID, err)
+	}
+
+	return nil
+}
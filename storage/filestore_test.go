@@ -0,0 +1,22 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/microhod/randflix-api/config"
+	"github.com/microhod/randflix-api/storage"
+	"github.com/microhod/randflix-api/storage/storagetest"
+)
+
+func TestFileStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		setenv(t, "RANDFLIXAPI_FILESTORE_PATH", filepath.Join(t.TempDir(), "randflix.db"))
+
+		s, err := (&storage.Config{Config: config.Config{StorageKind: "FileStore"}}).NewFileStore()
+		if err != nil {
+			t.Fatalf("NewFileStore() error: %s", err)
+		}
+		return s
+	})
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"math/rand"
@@ -12,111 +13,383 @@ import (
 	"github.com/microhod/randflix-api/model/title"
 )
 
+const (
+	// scanCheckInterval is how many titles are scanned between checks for cancellation
+	scanCheckInterval = 1000
+)
+
 // MemStore is in-memory storage
 type MemStore struct {
 	lock   sync.RWMutex
 	titles map[string]*title.Title
+	// search and facets are kept up to date with titles, by store and DeleteTitle
+	search *searchIndex
+	facets *facetIndex
 }
 
 type memStoreFilter func(*title.Title) bool
 
 // NewMemStore creates a new empty MemStore
 func (*Config) NewMemStore() (Storage, error) {
-	s := &MemStore{
+	return newMemStore(), nil
+}
+
+func newMemStore() *MemStore {
+	return &MemStore{
 		titles: map[string]*title.Title{},
+		search: newSearchIndex(),
+		facets: newFacetIndex(),
 	}
-
-	return s, nil
 }
 
 // Disconnect disconnects from storage (in this case it does nothing)
 func (m *MemStore) Disconnect() {}
 
-// ListTitles retrieves all titles from storage, given the pageSize and page
-// note: page is zero indexed
-func (m *MemStore) ListTitles(pageSize int, page int) ([]*title.Title, error) {
+// ListTitles retrieves a page of titles from storage
+func (m *MemStore) ListTitles(ctx context.Context, opts ListOptions) (*TitlePage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	msFilters, err := m.parseFilters(opts.Filters...)
+	if err != nil {
+		return nil, err
+	}
+
 	titles := []*title.Title{}
 
-	for _, t := range m.titles {
-		titles = append(titles, t)
+	err = m.scan(ctx, func(t *title.Title) {
+		if m.passes(t, msFilters) {
+			titles = append(titles, t)
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
+	total := len(titles)
 
-	// order by 'highest' ID first
 	sort.Slice(titles, func(i, j int) bool {
+		for _, f := range opts.Sort {
+			c := compareField(titles[i], titles[j], f.Field)
+			if f.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		// then by 'highest' ID first
 		return titles[i].ID > titles[j].ID
 	})
 
-	start := min(page*pageSize, len(titles))
-	end := min((page+1)*pageSize, len(titles))
+	page := opts.Page
+	if opts.After != "" {
+		// titles are in descending ID order, so the cursor is the first title with a lower id
+		page = 0
+		titles = titles[sort.Search(len(titles), func(i int) bool { return titles[i].ID < opts.After }):]
+	}
+	start := min(page*opts.PageSize, len(titles))
+	end := min((page+1)*opts.PageSize, len(titles))
 
-	return titles[start:end], nil
+	return &TitlePage{Titles: titles[start:end], Total: total}, nil
+}
+
+// EachTitle calls fn with every title in storage, without holding the lock while fn is called
+func (m *MemStore) EachTitle(ctx context.Context, fn func(t *title.Title) error) error {
+	// a single page of every title
+	page, err := m.ListTitles(ctx, ListOptions{PageSize: math.MaxInt32})
+	if err != nil {
+		return err
+	}
+
+	for _, t := range page.Titles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // AddTitle adds the title to storage
-func (m *MemStore) AddTitle(t *title.Title) (*title.Title, error) {
+func (m *MemStore) AddTitle(ctx context.Context, t *title.Title) (*title.Title, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	if m.titles[t.ID] != nil {
-		return nil, fmt.Errorf("title already exists with id: '%s'", t.ID)
+		return nil, fmt.Errorf("%w with id: '%s'", ErrAlreadyExists, t.ID)
 	}
 
-	m.titles[t.ID] = t
+	m.store(withRevision(t, 1))
 	return m.titles[t.ID], nil
 }
 
 // UpdateTitle replaces the title in storage
-func (m *MemStore) UpdateTitle(t *title.Title) (*title.Title, error) {
+func (m *MemStore) UpdateTitle(ctx context.Context, t *title.Title, revision int) (*title.Title, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	if m.titles[t.ID] == nil {
-		return nil, fmt.Errorf("title does not exist with id: '%s'", t.ID)
+	existing := m.titles[t.ID]
+	if existing == nil {
+		return nil, fmt.Errorf("%w with id: '%s'", ErrNotFound, t.ID)
+	}
+	if err := checkRevision(existing, revision); err != nil {
+		return nil, err
 	}
 
-	m.titles[t.ID] = t
+	m.store(withRevision(t, existing.Revision+1))
 	return m.titles[t.ID], nil
 }
 
+// PatchTitle applies the merge patch to the title in storage
+func (m *MemStore) PatchTitle(ctx context.Context, id string, patch []byte, revision int) (*title.Title, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	existing := m.titles[id]
+	if existing == nil {
+		return nil, fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
+	if err := checkRevision(existing, revision); err != nil {
+		return nil, err
+	}
+
+	patched, err := applyPatch(existing, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	m.store(withRevision(patched, existing.Revision+1))
+	return m.titles[id], nil
+}
+
+// BulkUpsert writes all the titles, holding the lock once for the whole batch
+func (m *MemStore) BulkUpsert(ctx context.Context, titles []*title.Title, mode BulkMode) ([]BulkResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	results := bulkResults(titles, mode, func(id string) *title.Title { return m.titles[id] })
+	for _, r := range results {
+		if r.Err == nil {
+			m.store(r.Title)
+		}
+	}
+
+	return results, nil
+}
+
+// set stores the title as it is, for storage which sets revisions itself (e.g. FileStore)
+func (m *MemStore) set(t *title.Title) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.store(t)
+}
+
+// store puts the title in storage and indexes it for search and facets
+// note: the lock must already be held
+func (m *MemStore) store(t *title.Title) {
+	if old := m.titles[t.ID]; old != nil {
+		m.facets.remove(old)
+	}
+	m.titles[t.ID] = t
+	m.search.add(t)
+	m.facets.add(t)
+}
+
 // GetTitle retrieves a title from storage by id
-func (m *MemStore) GetTitle(id string) (*title.Title, error) {
+func (m *MemStore) GetTitle(ctx context.Context, id string) (*title.Title, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	return m.titles[id], nil
 }
 
-// RandomTitle chooese a random title from storage (filtered by the filters)
-func (m *MemStore) RandomTitle(filters ...title.Filter) (*title.Title, error) {
+// DeleteTitle removes a title from storage by id
+func (m *MemStore) DeleteTitle(ctx context.Context, id string) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	var msFilters []memStoreFilter
+	if m.titles[id] == nil {
+		return fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
 
-	for _, tf := range filters {
-		if f, err := m.parseFilter(tf); err != nil {
-			return nil, fmt.Errorf("Error parsing filter: %s", err)
-		} else {
-			msFilters = append(msFilters, f)
+	m.facets.remove(m.titles[id])
+	delete(m.titles, id)
+	m.search.remove(id)
+	return nil
+}
+
+// Facets summarises the titles passing the filters
+// without any filters (or only filters with no effect) the maintained facet index is used, rather than counting every title
+func (m *MemStore) Facets(ctx context.Context, filters ...title.Filter) (*Facets, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if haveNoEffect(filters) {
+		return m.facets.facets(), nil
+	}
+
+	msFilters, err := m.parseFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	index := newFacetIndex()
+	err = m.scan(ctx, func(t *title.Title) {
+		if m.passes(t, msFilters) {
+			index.add(t)
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	list := []*title.Title{}
+	return index.facets(), nil
+}
 
-	for _, t := range m.titles {
+// CountTitles counts the titles passing the filters
+func (m *MemStore) CountTitles(ctx context.Context, filters ...title.Filter) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if haveNoEffect(filters) {
+		return len(m.titles), nil
+	}
+
+	msFilters, err := m.parseFilters(filters...)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = m.scan(ctx, func(t *title.Title) {
 		if m.passes(t, msFilters) {
-			list = append(list, t)
+			count++
 		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// SearchTitles finds up to limit titles matching the query, using the inverted index to find the titles to rank
+func (m *MemStore) SearchTitles(ctx context.Context, query string, limit int) ([]*title.Title, error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return []*title.Title{}, nil
 	}
 
-	if len(list) == 0 {
-		return nil, nil
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	candidates := []*title.Title{}
+	for id := range m.search.candidates(words) {
+		candidates = append(candidates, m.titles[id])
 	}
 
-	return list[rand.Intn(len(list))], nil
+	return rankTitles(candidates, words, limit), nil
+}
+
+// RandomTitle chooese a random title from storage (filtered by the filters)
+func (m *MemStore) RandomTitle(ctx context.Context, filters ...title.Filter) (*title.Title, error) {
+	titles, err := m.RandomTitles(ctx, 1, filters...)
+	if err != nil || len(titles) == 0 {
+		return nil, err
+	}
+
+	return titles[0], nil
+}
+
+// RandomTitles chooses up to count distinct random titles from storage (filtered by the filters)
+func (m *MemStore) RandomTitles(ctx context.Context, count int, filters ...title.Filter) ([]*title.Title, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list, err := m.filtered(ctx, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	count = min(count, len(list))
+
+	// partial fisher-yates shuffle, so we sample without replacement
+	for i := 0; i < count; i++ {
+		j := i + rand.Intn(len(list)-i)
+		list[i], list[j] = list[j], list[i]
+	}
+
+	return list[:count], nil
+}
+
+// SampleTitles chooses up to opts.Count distinct titles, with probability proportional to their weight
+func (m *MemStore) SampleTitles(ctx context.Context, opts SampleOptions) ([]*title.Title, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Weight.Kind == Uniform && opts.Seed == "" {
+		return m.RandomTitles(ctx, opts.Count, opts.Filters...)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	list, err := m.filtered(ctx, opts.Filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sampleTitles(list, opts), nil
+}
+
+// filtered finds every title passing the filters
+// note: the lock must already be held
+func (m *MemStore) filtered(ctx context.Context, filters ...title.Filter) ([]*title.Title, error) {
+	msFilters, err := m.parseFilters(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*title.Title{}
+	err = m.scan(ctx, func(t *title.Title) {
+		if m.passes(t, msFilters) {
+			list = append(list, t)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// scan calls fn for every title in storage, stopping early if the context is done
+// note: the lock must already be held
+func (m *MemStore) scan(ctx context.Context, fn func(t *title.Title)) error {
+	i := 0
+	for _, t := range m.titles {
+		if i%scanCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		i++
+
+		fn(t)
+	}
+	return nil
 }
 
 func (m *MemStore) passes(t *title.Title, filters []memStoreFilter) bool {
@@ -128,30 +401,102 @@ func (m *MemStore) passes(t *title.Title, filters []memStoreFilter) bool {
 	return true
 }
 
+func (m *MemStore) parseFilters(filters ...title.Filter) ([]memStoreFilter, error) {
+	var msFilters []memStoreFilter
+
+	for _, tf := range filters {
+		if f, err := m.parseFilter(tf); err != nil {
+			return nil, fmt.Errorf("Error parsing filter: %s", err)
+		} else {
+			msFilters = append(msFilters, f)
+		}
+	}
+
+	return msFilters, nil
+}
+
 func (m *MemStore) parseFilter(tf title.Filter) (memStoreFilter, error) {
 	var filter memStoreFilter
+	var err error
 
 	switch tf.(type) {
 	case title.OnServiceFilter:
-		filter = m.onService(tf.(title.OnServiceFilter).Service)
+		filter = m.onService(tf.(title.OnServiceFilter).Services...)
 	case title.IsGenreFilter:
 		filter = m.isGenre(tf.(title.IsGenreFilter).Genres...)
+	case title.ExcludeGenresFilter:
+		filter = m.excludeGenres(tf.(title.ExcludeGenresFilter).Genres...)
 	case title.ScoreBetweenFilter:
 		f := tf.(title.ScoreBetweenFilter)
 		filter = m.scoreBetween(f.Kind, f.Min, f.Max)
+	case title.YearBetweenFilter:
+		f := tf.(title.YearBetweenFilter)
+		filter = m.yearBetween(f.Min, f.Max)
+	case title.ExcludeIDsFilter:
+		filter = m.excludeIDs(tf.(title.ExcludeIDsFilter).IDs...)
+	case title.AndFilter:
+		filter, err = m.and(tf.(title.AndFilter).Filters...)
+	case title.OrFilter:
+		filter, err = m.or(tf.(title.OrFilter).Filters...)
+	case title.NotFilter:
+		filter, err = m.not(tf.(title.NotFilter).Filter)
 	default:
 		return nil, fmt.Errorf("Unsupported title filter type: %s", reflect.TypeOf(tf))
 	}
 
-	return filter, nil
+	return filter, err
+}
+
+func (m *MemStore) and(tfs ...title.Filter) (memStoreFilter, error) {
+	filters, err := m.parseFilters(tfs...)
+	if err != nil {
+		return nil, err
+	}
+	return func(t *title.Title) bool {
+		return m.passes(t, filters)
+	}, nil
 }
 
-func (m *MemStore) onService(name string) memStoreFilter {
-	if name == "" {
+func (m *MemStore) or(tfs ...title.Filter) (memStoreFilter, error) {
+	if len(tfs) == 0 {
+		return m.truefilter, nil
+	}
+	filters, err := m.parseFilters(tfs...)
+	if err != nil {
+		return nil, err
+	}
+	return func(t *title.Title) bool {
+		for _, filter := range filters {
+			if filter(t) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func (m *MemStore) not(tf title.Filter) (memStoreFilter, error) {
+	filter, err := m.parseFilter(tf)
+	if err != nil {
+		return nil, err
+	}
+	return func(t *title.Title) bool {
+		return !filter(t)
+	}, nil
+}
+
+func (m *MemStore) onService(names ...string) memStoreFilter {
+	names = nonEmpty(names)
+	if len(names) == 0 {
 		return m.truefilter
 	}
 	return func(t *title.Title) bool {
-		return t != nil && t.Services != nil && t.Services[name] != nil && t.Services[name].URL != ""
+		for _, name := range names {
+			if t != nil && t.Services != nil && t.Services[name] != nil && t.Services[name].URL != "" {
+				return true
+			}
+		}
+		return false
 	}
 }
 
@@ -166,6 +511,21 @@ func (m *MemStore) isGenre(names ...string) memStoreFilter {
 	}
 }
 
+func (m *MemStore) excludeGenres(names ...string) memStoreFilter {
+	names = nonEmpty(names)
+	if len(names) == 0 {
+		return m.truefilter
+	}
+	return func(t *title.Title) bool {
+		for _, n := range names {
+			if containsCaseInsensitive(t.Genres, n) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
 func (m *MemStore) scoreBetween(kind string, min int, max int) memStoreFilter {
 	if kind == "" {
 		return m.truefilter
@@ -174,8 +534,33 @@ func (m *MemStore) scoreBetween(kind string, min int, max int) memStoreFilter {
 		max = math.MaxInt64
 	}
 	return func(t *title.Title) bool {
+		score, ok := t.Scores[kind]
+		return ok && score >= min && score <= max
+	}
+}
 
-		return t.Scores[kind] >= min && t.Scores[kind] <= max
+func (m *MemStore) yearBetween(min int, max int) memStoreFilter {
+	if min == 0 && max == 0 {
+		return m.truefilter
+	}
+	if max == 0 {
+		max = math.MaxInt64
+	}
+	return func(t *title.Title) bool {
+		return t.Year >= min && t.Year <= max
+	}
+}
+
+func (m *MemStore) excludeIDs(ids ...string) memStoreFilter {
+	if len(ids) == 0 {
+		return m.truefilter
+	}
+	excluded := map[string]bool{}
+	for _, id := range ids {
+		excluded[id] = true
+	}
+	return func(t *title.Title) bool {
+		return !excluded[t.ID]
 	}
 }
 
@@ -183,6 +568,41 @@ func (m *MemStore) truefilter(*title.Title) bool {
 	return true
 }
 
+// compareField compares the field of two titles, returning -1, 0 or 1 (see SortField for the supported fields)
+func compareField(a *title.Title, b *title.Title, field string) int {
+	switch field {
+	case "id":
+		return strings.Compare(a.ID, b.ID)
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	case "year":
+		return compareInts(a.Year, b.Year)
+	}
+
+	kind := scoreKind(field)
+	aScore, aOk := a.Scores[kind]
+	bScore, bOk := b.Scores[kind]
+	switch {
+	case aOk && bOk:
+		return compareInts(aScore, bScore)
+	case aOk:
+		return 1
+	case bOk:
+		return -1
+	}
+	return 0
+}
+
+func compareInts(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
 func min(a, b int) int {
 	if a <= b {
 		return a
@@ -190,6 +610,17 @@ func min(a, b int) int {
 	return b
 }
 
+// nonEmpty returns the items which are not empty strings
+func nonEmpty(items []string) []string {
+	result := []string{}
+	for _, i := range items {
+		if i != "" {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
 func containsCaseInsensitive(items []string, term string) bool {
 	for _, i := range items {
 		if strings.ToLower(i) == strings.ToLower(term) {
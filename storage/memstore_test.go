@@ -0,0 +1,18 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/microhod/randflix-api/storage"
+	"github.com/microhod/randflix-api/storage/storagetest"
+)
+
+func TestMemStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := (&storage.Config{}).NewMemStore()
+		if err != nil {
+			t.Fatalf("NewMemStore() error: %s", err)
+		}
+		return s
+	})
+}
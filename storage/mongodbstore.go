@@ -12,9 +12,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gobeam/mongo-go-pagination"
-
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -24,13 +23,52 @@ import (
 
 const (
 	envPrefix = "MONGO"
+
+	// mongo error code for a duplicate key
+	mongoDuplicateKey = 11000
+
+	// maxPatchAttempts is how many times a patch is retried if the title changes at the same time
+	maxPatchAttempts = 5
+
+	// nameWordsField and descriptionWordsField hold the (distinct) search words of a title's name and description
+	// they're written with every title and indexed, so that searches don't scan every title
+	nameWordsField        = "nameWords"
+	descriptionWordsField = "descriptionWords"
+
+	// lowerGenresField holds a title's (distinct) lower case genres, which are indexed for case insensitive genre filters
+	lowerGenresField = "lowerGenres"
+
+	// sampleHashField holds the hash of a title's id (see idHash), so seeded samples can find keys within the aggregation
+	sampleHashField = "sampleHash"
+
+	// migrationBatchSize is the most titles updated in a single write by a migration
+	migrationBatchSize = 1000
 )
 
+// mongoMigrations update the stored titles, each is applied once (in order) when MongoStore starts
+// applied migrations are recorded by version (their 1 indexed position) in the migrations collection
+// note: instances starting at the same time may both apply a migration, so they must be safe to apply again
+var mongoMigrations = []func(m *MongoStore, ctx context.Context) error{
+	// 1: the search words fields
+	(*MongoStore).writeDerivedFields,
+	// 2: the lower case genres field
+	(*MongoStore).writeDerivedFields,
+	// 3: the sample hash field
+	(*MongoStore).writeDerivedFields,
+}
+
 // MongoStore is storage using mongodb
 type MongoStore struct {
-	client *mongo.Client
-	titles *mongo.Collection
-	config *mongoConfig
+	client     *mongo.Client
+	titles     *mongo.Collection
+	migrations *mongo.Collection
+	config     *mongoConfig
+}
+
+// mongoPatch is an update which changes only the fields of a title which have been set or removed
+type mongoPatch struct {
+	set   bson.D
+	unset bson.D
 }
 
 type mongoConfig struct {
@@ -38,6 +76,8 @@ type mongoConfig struct {
 	Database         string        `default:"randflix"`
 	Collection       string        `default:"titles"`
 	OperationTimeout time.Duration `default:"10s"`
+	// MigrationTimeout bounds applying migrations on startup, which may update every title
+	MigrationTimeout time.Duration `default:"10m"`
 	Server           string
 }
 
@@ -45,9 +85,7 @@ func (c *mongoConfig) String() string {
 	// get copy of instance so that we don't override the URI in the real config
 	conf := *c
 
-	// mask basic auth password (if exists)
-	basicAuthPattern := regexp.MustCompile(`(:\/\/[^\/]+:)[^\/]+(@)`)
-	conf.URI = basicAuthPattern.ReplaceAllString(conf.URI, `$1*****$2`)
+	conf.URI = maskPassword(conf.URI)
 
 	s, _ := json.MarshalIndent(conf, "", "\t")
 	return string(s)
@@ -75,11 +113,124 @@ func (c *Config) NewMongoStore() (Storage, error) {
 	db := client.Database(mc.Database)
 	collection := db.Collection(mc.Collection)
 
-	return &MongoStore{
-		client: client,
-		titles: collection,
-		config: mc,
-	}, nil
+	m := &MongoStore{
+		client:     client,
+		titles:     collection,
+		migrations: db.Collection(mc.Collection + "_migrations"),
+		config:     mc,
+	}
+	if err := m.createIndexes(); err != nil {
+		m.Disconnect()
+		return nil, fmt.Errorf("failed to create indexes: %s", err)
+	}
+	if err := m.migrate(); err != nil {
+		m.Disconnect()
+		return nil, fmt.Errorf("failed to migrate titles: %s", err)
+	}
+
+	return m, nil
+}
+
+// createIndexes creates any indexes which don't already exist
+func (m *MongoStore) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.OperationTimeout)
+	defer cancel()
+
+	// the text index has no language, so that words aren't stemmed (or ignored as stop words), as with other storage
+	search := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "name", Value: "text"}, {Key: "description", Value: "text"}},
+			Options: options.Index().
+				SetName("titles_search").
+				SetDefaultLanguage("none").
+				SetWeights(bson.D{{Key: "name", Value: nameSearchWeight}, {Key: "description", Value: descriptionSearchWeight}}),
+		},
+		{Keys: bson.D{{Key: nameWordsField, Value: 1}}, Options: options.Index().SetName("titles_name_words")},
+		{Keys: bson.D{{Key: descriptionWordsField, Value: 1}}, Options: options.Index().SetName("titles_description_words")},
+	}
+	genres := mongo.IndexModel{Keys: bson.D{{Key: lowerGenresField, Value: 1}}, Options: options.Index().SetName("titles_lower_genres")}
+
+	_, err := m.titles.Indexes().CreateMany(ctx, append(search, genres))
+	return err
+}
+
+// migrate applies any migrations which have not yet been applied
+func (m *MongoStore) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.MigrationTimeout)
+	defer cancel()
+
+	cursor, err := m.migrations.Find(ctx, bson.M{})
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %s", err)
+	}
+	var records []struct {
+		Version int `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &records); err != nil {
+		return fmt.Errorf("failed to decode applied migrations: %s", err)
+	}
+	applied := map[int]bool{}
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+
+	for version := 1; version <= len(mongoMigrations); version++ {
+		if applied[version] {
+			continue
+		}
+		log.Printf("(storage): applying mongo migration %d", version)
+
+		if err := mongoMigrations[version-1](m, ctx); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %s", version, err)
+		}
+		record := bson.M{"$setOnInsert": bson.M{"appliedAt": time.Now()}}
+		if _, err := m.migrations.UpdateOne(ctx, bson.M{"_id": version}, record, options.Update().SetUpsert(true)); err != nil {
+			return fmt.Errorf("failed to record migration %d: %s", version, err)
+		}
+	}
+
+	return nil
+}
+
+// writeDerivedFields writes the derived fields (see derivedFields) of every title, in batches
+func (m *MongoStore) writeDerivedFields(ctx context.Context) error {
+	cursor, err := m.titles.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	models := []mongo.WriteModel{}
+	write := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := m.titles.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		var t *title.Title
+		if err := cursor.Decode(&t); err != nil {
+			return fmt.Errorf("failed to decode title: %s", err)
+		}
+		// titles written since they were read already have the fields of their new revision
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: t.ID}, m.revisionFilter(t.Revision)}).
+			SetUpdate(bson.M{"$set": derivedFields(t)}))
+
+		if len(models) == migrationBatchSize {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	return write()
 }
 
 // parse server from URI (the 'server' will be what we use for logging)
@@ -127,29 +278,39 @@ func (m *MongoStore) Disconnect() {
 }
 
 // RandomTitle picks a random title based on the filters passed in
-func (m *MongoStore) RandomTitle(titleFilters ...title.Filter) (*title.Title, error) {
+func (m *MongoStore) RandomTitle(ctx context.Context, titleFilters ...title.Filter) (*title.Title, error) {
+	titles, err := m.RandomTitles(ctx, 1, titleFilters...)
+	if err != nil || len(titles) == 0 {
+		return nil, err
+	}
+
+	return titles[0], nil
+}
+
+// RandomTitles picks up to count distinct random titles based on the filters passed in
+func (m *MongoStore) RandomTitles(ctx context.Context, count int, titleFilters ...title.Filter) ([]*title.Title, error) {
 
 	filters, err := m.parseFilters(titleFilters...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse filters: %s", err)
 	}
 
-	sampleOne := mongo.Pipeline{
+	sample := mongo.Pipeline{
 		{
 			{Key: "$match", Value: filters},
 		},
 		{
 			// $sample handles random sampling for us
 			{Key: "$sample", Value: bson.D{
-				{Key: "size", Value: 1},
+				{Key: "size", Value: count},
 			}},
 		},
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.config.OperationTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
 	defer cancel()
 
-	cursor, err := m.titles.Aggregate(ctx, sampleOne)
+	cursor, err := m.titles.Aggregate(ctx, sample)
 	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
 		return nil, fmt.Errorf("failed to sample: %s", err)
 	}
@@ -159,45 +320,506 @@ func (m *MongoStore) RandomTitle(titleFilters ...title.Filter) (*title.Title, er
 		return nil, fmt.Errorf("failed to read cursor from sample aggregation: %s", err)
 	}
 
-	if len(rawDocuments) == 0 {
-		return nil, nil
+	titles := []*title.Title{}
+	seen := map[string]bool{}
+	for _, raw := range rawDocuments {
+		var title *title.Title
+		if err = bson.Unmarshal(raw, &title); err != nil {
+			return nil, fmt.Errorf("failed to unmarshall bson to title: %s", err)
+		}
+
+		// $sample can return the same document more than once
+		if seen[title.ID] {
+			continue
+		}
+		seen[title.ID] = true
+		titles = append(titles, title)
 	}
 
-	var title *title.Title
-	if bson.Unmarshal(rawDocuments[0], &title); err != nil {
-		return nil, fmt.Errorf("failed to unmarshall bson to title: %s", err)
+	return titles, nil
+}
+
+// SampleTitles picks up to opts.Count distinct titles, with probability proportional to their weight
+// the titles are ordered by a random key for their weight (see sampleTitles) within the aggregation,
+// so only the titles chosen are sent back (note: $rand needs mongodb 4.4.2 or later)
+// $rand can't be seeded, so with a seed the key is found from the stored hash of each title's id (see seededUniform)
+func (m *MongoStore) SampleTitles(ctx context.Context, opts SampleOptions) ([]*title.Title, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Weight.Kind == Uniform && opts.Seed == "" {
+		return m.RandomTitles(ctx, opts.Count, opts.Filters...)
+	}
+
+	filters, err := m.parseFilters(opts.Filters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filters: %s", err)
 	}
 
-	return title, nil
+	weight := opts.Weight
+
+	var expression interface{} = 1
+	switch weight.Kind {
+	case ScoreWeight:
+		score := fmt.Sprintf("scores.%s", weight.ScoreKind)
+		expression = bson.D{{Key: "$toDouble", Value: "$" + score}}
+		filters = append(filters, bson.E{Key: score, Value: bson.D{{Key: "$gt", Value: 0}}})
+	case RecencyWeight:
+		age := bson.D{{Key: "$max", Value: bson.A{
+			bson.D{{Key: "$subtract", Value: bson.A{time.Now().Year(), bson.D{{Key: "$ifNull", Value: bson.A{"$year", 0}}}}}},
+			0,
+		}}}
+		expression = bson.D{{Key: "$pow", Value: bson.A{0.5, bson.D{{Key: "$divide", Value: bson.A{age, recencyHalfLife}}}}}}
+	}
+
+	// $rand is in [0, 1), so 1 - $rand is never 0
+	var uniform interface{} = bson.D{{Key: "$subtract", Value: bson.A{1, bson.D{{Key: "$rand", Value: bson.D{}}}}}}
+	if opts.Seed != "" {
+		uniform = m.seededUniformExpression(opts.Seed)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filters}},
+		{{Key: "$addFields", Value: bson.D{{Key: "weightKey", Value: bson.D{{Key: "$divide", Value: bson.A{
+			bson.D{{Key: "$ln", Value: uniform}},
+			expression,
+		}}}}}}},
+		// ties are broken by id, so that a seed always chooses the same titles
+		{{Key: "$sort", Value: bson.D{{Key: "weightKey", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: opts.Count}},
+		{{Key: "$project", Value: bson.D{{Key: "weightKey", Value: 0}}}},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
+	defer cancel()
+
+	cursor, err := m.titles.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample: %s", err)
+	}
+
+	titles := []*title.Title{}
+	if err = cursor.All(ctx, &titles); err != nil {
+		return nil, fmt.Errorf("failed to read cursor from weighted sample aggregation: %s", err)
+	}
+
+	return titles, nil
+}
+
+// seededUniformExpression is an expression for seededUniform of the seed and each title, from its stored hash
+// every value is a 64 bit integer, so the polynomial is computed exactly (as in seededUniform)
+func (m *MongoStore) seededUniformExpression(seed string) bson.D {
+	coefficients := seedCoefficients(seed)
+	hash := bson.D{{Key: "$toLong", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$" + sampleHashField, 0}}}}}
+
+	var v interface{} = coefficients[0]
+	for _, c := range coefficients[1:] {
+		v = bson.D{{Key: "$mod", Value: bson.A{
+			bson.D{{Key: "$add", Value: bson.A{bson.D{{Key: "$multiply", Value: bson.A{v, hash}}}, c}}},
+			int64(seedModulus),
+		}}}
+	}
+
+	return bson.D{{Key: "$divide", Value: bson.A{
+		bson.D{{Key: "$add", Value: bson.A{v, int64(1)}}},
+		int64(seedModulus),
+	}}}
 }
 
 // AddTitle adds the title passed in
-func (m *MongoStore) AddTitle(t *title.Title) (*title.Title, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), m.config.OperationTimeout)
+func (m *MongoStore) AddTitle(ctx context.Context, t *title.Title) (*title.Title, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
+	defer cancel()
+
+	t = withRevision(t, 1)
+	document, err := toStoredDocument(t)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = m.titles.InsertOne(ctx, document)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, fmt.Errorf("%w with id: '%s'", ErrAlreadyExists, t.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// UpdateTitle updates the title passed in, if it's still at the revision expected
+func (m *MongoStore) UpdateTitle(ctx context.Context, t *title.Title, revision int) (*title.Title, error) {
+	update, err := m.replacement(t)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.D{{Key: "_id", Value: t.ID}}
+	if revision != AnyRevision {
+		filter = append(filter, m.revisionFilter(revision))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
 	defer cancel()
 
-	_, err := m.titles.InsertOne(ctx, t)
+	updated, err := m.update(ctx, filter, update)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, m.notUpdated(ctx, t.ID, revision)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return t, err
+	return updated, nil
 }
 
-// UpdateTitle updates the title passed in
-func (m *MongoStore) UpdateTitle(t *title.Title) (*title.Title, error) {
-	filter := bson.M{"_id": t.ID}
+// BulkUpsert writes all the titles with a single (unordered) bulk write
+func (m *MongoStore) BulkUpsert(ctx context.Context, titles []*title.Title, mode BulkMode) ([]BulkResult, error) {
+	if len(titles) == 0 {
+		return []BulkResult{}, nil
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.config.OperationTimeout)
+	models := []mongo.WriteModel{}
+	for _, t := range titles {
+		if mode == InsertOnly {
+			document, err := toStoredDocument(withRevision(t, 1))
+			if err != nil {
+				return nil, err
+			}
+			models = append(models, mongo.NewInsertOneModel().SetDocument(document))
+			continue
+		}
+
+		update, err := m.replacement(t)
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": t.ID}).
+			SetUpdate(update.document()).
+			SetUpsert(true))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
 	defer cancel()
 
-	_, err := m.titles.ReplaceOne(ctx, filter, t)
+	result, err := m.titles.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+
+	failed := map[int]error{}
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = writeErr.WriteError
+			if writeErr.Code == mongoDuplicateKey {
+				failed[writeErr.Index] = fmt.Errorf("%w with id: '%s'", ErrAlreadyExists, titles[writeErr.Index].ID)
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// updated titles could be at any revision, so find out what they are now
+	revisions, err := m.revisions(ctx, titles, result.UpsertedIDs, failed, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BulkResult, len(titles))
+	for i, t := range titles {
+		_, upserted := result.UpsertedIDs[int64(i)]
+		switch {
+		case failed[i] != nil:
+			results[i] = BulkResult{Err: failed[i]}
+		case mode == InsertOnly || upserted:
+			results[i] = BulkResult{Title: withRevision(t, 1), Created: true}
+		default:
+			results[i] = BulkResult{Title: withRevision(t, revisions[t.ID])}
+		}
+	}
+
+	return results, nil
+}
+
+// revisions gets the current revision of each title which was updated (rather than created or failed) by a bulk write
+func (m *MongoStore) revisions(ctx context.Context, titles []*title.Title, upserted map[int64]interface{}, failed map[int]error, mode BulkMode) (map[string]int, error) {
+	revisions := map[string]int{}
+	if mode == InsertOnly {
+		return revisions, nil
+	}
+
+	ids := []string{}
+	for i, t := range titles {
+		if _, ok := upserted[int64(i)]; !ok && failed[i] == nil {
+			ids = append(ids, t.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return revisions, nil
+	}
+
+	opts := options.Find().SetProjection(bson.M{"revision": 1})
+	cursor, err := m.titles.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get revisions: %s", err)
+	}
+
+	var updated []*title.Title
+	if err := cursor.All(ctx, &updated); err != nil {
+		return nil, fmt.Errorf("failed to decode revisions: %s", err)
+	}
+	for _, t := range updated {
+		revisions[t.ID] = t.Revision
+	}
+
+	return revisions, nil
+}
+
+// PatchTitle applies the merge patch using $set and $unset, only writing if the title hasn't changed since it was read
+func (m *MongoStore) PatchTitle(ctx context.Context, id string, patch []byte, revision int) (*title.Title, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
+	defer cancel()
+
+	for attempt := 0; attempt < maxPatchAttempts; attempt++ {
+		var existing *title.Title
+		err := m.titles.FindOne(ctx, bson.M{"_id": id}).Decode(&existing)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRevision(existing, revision); err != nil {
+			return nil, err
+		}
+
+		patched, err := applyPatch(existing, patch)
+		if err != nil {
+			return nil, err
+		}
+
+		update, err := m.patch(existing, patched)
+		if err != nil {
+			return nil, err
+		}
+
+		filter := bson.D{{Key: "_id", Value: id}, m.revisionFilter(existing.Revision)}
+
+		updated, err := m.update(ctx, filter, update)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// the title was changed (or deleted) since we read it, so try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return updated, nil
+	}
+
+	return nil, fmt.Errorf("%w too many times while patching title with id: '%s'", ErrConflict, id)
+}
+
+// update applies the update (incrementing the revision) to the title matching the filter, returning the updated title
+func (m *MongoStore) update(ctx context.Context, filter bson.D, update *mongoPatch) (*title.Title, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated *title.Title
+	err := m.titles.FindOneAndUpdate(ctx, filter, update.document(), opts).Decode(&updated)
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+// notUpdated works out why a title wasn't updated, it either doesn't exist or is at a different revision
+func (m *MongoStore) notUpdated(ctx context.Context, id string, revision int) error {
+	existing, err := m.GetTitle(ctx, id)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
+	if err := checkRevision(existing, revision); err != nil {
+		return err
+	}
+
+	// the title was changed again, back to the revision expected
+	return fmt.Errorf("%w with id: '%s'", ErrConflict, id)
+}
+
+// replacement is an update which replaces every field of the title (incrementing the revision)
+func (m *MongoStore) replacement(t *title.Title) (*mongoPatch, error) {
+	document, err := toStoredDocument(t)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &mongoPatch{}
+	for _, e := range document {
+		// the id never changes and the revision is incremented by the update
+		if e.Key != "_id" && e.Key != "revision" {
+			update.set = append(update.set, e)
+		}
+	}
+
+	return update, nil
+}
+
+// revisionFilter matches titles at the revision
+func (m *MongoStore) revisionFilter(revision int) bson.E {
+	if revision == 0 {
+		// titles stored before revisions were added don't have one
+		return bson.E{Key: "revision", Value: bson.M{"$in": bson.A{0, nil}}}
+	}
+	return bson.E{Key: "revision", Value: revision}
+}
+
+// patch works out the update which turns the existing title into the patched title
+func (m *MongoStore) patch(existing *title.Title, patched *title.Title) (*mongoPatch, error) {
+	before, err := toDocument(existing)
+	if err != nil {
+		return nil, err
+	}
+	after, err := toDocument(patched)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &mongoPatch{}
+	update.diff("", before, after)
+	// the derived fields aren't part of the title, so they're always written
+	update.set = append(update.set, derivedFields(patched)...)
+
+	return update, nil
+}
+
+// diff adds the changes which turn the document before into the document after, where both are at path
+func (u *mongoPatch) diff(path string, before bson.D, after bson.D) {
+	previous := map[string]interface{}{}
+	for _, e := range before {
+		previous[e.Key] = e.Value
+	}
+
+	for _, e := range after {
+		key := e.Key
+		if path != "" {
+			key = fmt.Sprintf("%s.%s", path, e.Key)
+		}
+
+		old, existed := previous[e.Key]
+		oldDocument, oldIsDocument := old.(bson.D)
+		newDocument, newIsDocument := e.Value.(bson.D)
+
+		switch {
+		case existed && oldIsDocument && newIsDocument:
+			u.diff(key, oldDocument, newDocument)
+		case existed && reflect.DeepEqual(old, e.Value):
+			// unchanged
+		default:
+			u.set = append(u.set, bson.E{Key: key, Value: e.Value})
+		}
+	}
+
+	removed := map[string]bool{}
+	for _, e := range before {
+		removed[e.Key] = true
+	}
+	for _, e := range after {
+		removed[e.Key] = false
+	}
+	for _, e := range before {
+		if removed[e.Key] {
+			key := e.Key
+			if path != "" {
+				key = fmt.Sprintf("%s.%s", path, e.Key)
+			}
+			u.unset = append(u.unset, bson.E{Key: key, Value: ""})
+		}
+	}
+}
+
+// document converts the patch to an update document, which also increments the revision
+func (u *mongoPatch) document() bson.D {
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "revision", Value: 1}}}}
+	if len(u.set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: u.set})
+	}
+	if len(u.unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: u.unset})
+	}
+	return update
+}
+
+// toDocument converts a title to a bson document, as it would be stored
+func toDocument(t *title.Title) (bson.D, error) {
+	raw, err := bson.Marshal(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal title to bson: %s", err)
+	}
+
+	var document bson.D
+	if err := bson.Unmarshal(raw, &document); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal bson to document: %s", err)
+	}
+	return document, nil
+}
 
-	return t, err
+// toStoredDocument converts a title to the document stored for it, which also has its derived fields
+func toStoredDocument(t *title.Title) (bson.D, error) {
+	document, err := toDocument(t)
+	if err != nil {
+		return nil, err
+	}
+	return append(document, derivedFields(t)...), nil
+}
+
+// derivedFields are worked out from a title and stored with it (so they can be indexed)
+// they aren't part of the title, so are ignored when reading it
+// note: when they change, a migration should write them for the titles already stored
+func derivedFields(t *title.Title) bson.D {
+	return bson.D{
+		{Key: nameWordsField, Value: distinctWords(t.Name)},
+		{Key: descriptionWordsField, Value: distinctWords(t.Description)},
+		{Key: lowerGenresField, Value: lowerCase(t.Genres)},
+		{Key: sampleHashField, Value: idHash(t.ID)},
+	}
+}
+
+// lowerCase converts the values to lower case, without repeats
+func lowerCase(values []string) []string {
+	lower := []string{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		v = strings.ToLower(v)
+		if !seen[v] {
+			seen[v] = true
+			lower = append(lower, v)
+		}
+	}
+	return lower
+}
+
+// distinctWords are the search words of the text, without repeats
+func distinctWords(text string) []string {
+	words := []string{}
+	seen := map[string]bool{}
+	for _, w := range searchWords(text) {
+		if !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	return words
 }
 
 // GetTitle gets a single title by id, if it doesn't exist, it returns nil
-func (m *MongoStore) GetTitle(id string) (*title.Title, error) {
+func (m *MongoStore) GetTitle(ctx context.Context, id string) (*title.Title, error) {
 	filter := bson.M{"_id": id}
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.config.OperationTimeout)
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
 	defer cancel()
 
 	var title *title.Title
@@ -211,29 +833,319 @@ func (m *MongoStore) GetTitle(id string) (*title.Title, error) {
 	return title, err
 }
 
-// ListTitles lists all elements in the mongo store, by page and pageSize
-func (m *MongoStore) ListTitles(pageSize int, page int) ([]*title.Title, error) {
+// DeleteTitle deletes a single title by id
+func (m *MongoStore) DeleteTitle(ctx context.Context, id string) error {
+	filter := bson.M{"_id": id}
 
-	// empty filter
-	filter := bson.M{}
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
+	defer cancel()
 
-	data, err := mongopagination.New(m.titles).Filter(filter).Limit(int64(pageSize)).Page(int64(page)).Find()
+	result, err := m.titles.DeleteOne(ctx, filter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get page %d of titles with a page size of %d: %s", page, pageSize, err)
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
+
+	return nil
+}
+
+// ListTitles lists a page of titles in the mongo store, ordered by the sort fields and then 'highest' ID first
+func (m *MongoStore) ListTitles(ctx context.Context, opts ListOptions) (*TitlePage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	filters, err := m.parseFilters(opts.Filters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filters: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
+	defer cancel()
+
+	total, err := m.titles.CountDocuments(ctx, filters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count titles: %s", err)
+	}
+
+	skip := opts.Page * opts.PageSize
+	if opts.After != "" {
+		filters = append(filters, bson.E{Key: "_id", Value: bson.M{"$lt": opts.After}})
+		skip = 0
+	}
+
+	findOpts := options.Find().
+		SetSort(m.sort(opts.Sort)).
+		SetSkip(int64(skip)).
+		SetLimit(int64(opts.PageSize))
+
+	cursor, err := m.titles.Find(ctx, filters, findOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page %d of titles with a page size of %d: %s", opts.Page, opts.PageSize, err)
 	}
 
 	titles := []*title.Title{}
-	for _, raw := range data.Data {
-		var title *title.Title
+	if err = cursor.All(ctx, &titles); err != nil {
+		return nil, fmt.Errorf("failed to read cursor of titles: %s", err)
+	}
 
-		if bson.Unmarshal(raw, &title); err != nil {
-			return nil, fmt.Errorf("failed to unmarshall bson to title: %s", err)
+	return &TitlePage{Titles: titles, Total: int(total)}, nil
+}
+
+// sort converts the sort fields to a sort document, ending with 'highest' ID first
+// mongo already sorts missing scores before all others
+func (m *MongoStore) sort(fields []SortField) bson.D {
+	sort := bson.D{}
+	byID := false
+	for _, f := range fields {
+		key := f.Field
+		if key == "id" {
+			key = "_id"
+			byID = true
 		}
+		direction := 1
+		if f.Descending {
+			direction = -1
+		}
+		sort = append(sort, bson.E{Key: key, Value: direction})
+	}
 
-		titles = append(titles, title)
+	// a key can't be repeated, and ids are unique so nothing sorts after them
+	if byID {
+		return sort
 	}
+	return append(sort, bson.E{Key: "_id", Value: -1})
+}
 
-	return titles, nil
+// CountTitles counts the titles passing the filters
+func (m *MongoStore) CountTitles(ctx context.Context, titleFilters ...title.Filter) (int, error) {
+	filters, err := m.parseFilters(titleFilters...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse filters: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
+	defer cancel()
+
+	count, err := m.titles.CountDocuments(ctx, filters)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count titles: %s", err)
+	}
+
+	return int(count), nil
+}
+
+// SearchTitles finds up to limit titles matching the query
+// an anchored regex matches the last word as a prefix of the indexed name or description words. Any other (whole) words
+// are found with the text index, best matches first, otherwise candidates are found in order of how well the last word
+// matches (in the name, then the description, whole words first). So when there are more than maxSearchCandidates,
+// the best matches are still ranked
+func (m *MongoStore) SearchTitles(ctx context.Context, query string, limit int) ([]*title.Title, error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return []*title.Title{}, nil
+	}
+
+	last := words[len(words)-1]
+	prefix := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(last)}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
+	defer cancel()
+
+	if whole := words[:len(words)-1]; len(whole) > 0 {
+		filter := bson.D{
+			// quoted words must all be present
+			{Key: "$text", Value: bson.M{"$search": `"` + strings.Join(whole, `" "`) + `"`}},
+			{Key: "$or", Value: bson.A{bson.M{nameWordsField: prefix}, bson.M{descriptionWordsField: prefix}}},
+		}
+		score := bson.M{"score": bson.M{"$meta": "textScore"}}
+
+		candidates, err := m.searchCandidates(ctx, filter, options.Find().SetProjection(score).SetSort(score).SetLimit(maxSearchCandidates))
+		if err != nil {
+			return nil, err
+		}
+		return rankTitles(candidates, words, limit), nil
+	}
+
+	matches := []bson.M{
+		{nameWordsField: last},
+		{nameWordsField: prefix},
+		{descriptionWordsField: last},
+		{descriptionWordsField: prefix},
+	}
+
+	candidates := []*title.Title{}
+	ids := bson.A{}
+	for _, match := range matches {
+		if len(candidates) >= maxSearchCandidates {
+			break
+		}
+
+		filter := bson.D{{Key: "$and", Value: bson.A{match, bson.M{"_id": bson.M{"$nin": ids}}}}}
+		found, err := m.searchCandidates(ctx, filter, options.Find().SetLimit(int64(maxSearchCandidates-len(candidates))))
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range found {
+			candidates = append(candidates, t)
+			ids = append(ids, t.ID)
+		}
+	}
+
+	return rankTitles(candidates, words, limit), nil
+}
+
+// searchCandidates finds the titles matching a search filter, to be ranked
+func (m *MongoStore) searchCandidates(ctx context.Context, filter bson.D, opts *options.FindOptions) ([]*title.Title, error) {
+	cursor, err := m.titles.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search titles: %s", err)
+	}
+
+	candidates := []*title.Title{}
+	if err = cursor.All(ctx, &candidates); err != nil {
+		return nil, fmt.Errorf("failed to read cursor of titles: %s", err)
+	}
+	return candidates, nil
+}
+
+// mongoFacets is the result of the facets aggregation, with a field for each of its sub pipelines
+type mongoFacets struct {
+	Total      []struct{ Count int }
+	Genres     mongoFacetCounts
+	Services   mongoFacetCounts
+	ScoreKinds mongoFacetCounts `bson:"scoreKinds"`
+	Years      []YearRange
+}
+
+type mongoFacetCounts []struct {
+	Value string `bson:"_id"`
+	Count int
+}
+
+// facetCounts orders the counts in the same way as other storage
+func (c mongoFacetCounts) facetCounts() []FacetCount {
+	counts := map[string]int{}
+	for _, fc := range c {
+		counts[fc.Value] = fc.Count
+	}
+	return facetCounts(counts)
+}
+
+// Facets summarises the titles passing the filters, with a single $facet aggregation
+func (m *MongoStore) Facets(ctx context.Context, titleFilters ...title.Filter) (*Facets, error) {
+	filters, err := m.parseFilters(titleFilters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filters: %s", err)
+	}
+
+	genres := bson.A{
+		// lower case genres, without duplicates, so each title is only counted once per genre
+		bson.D{{Key: "$project", Value: bson.D{{Key: "value", Value: bson.D{{Key: "$setUnion", Value: bson.A{
+			bson.D{{Key: "$map", Value: bson.D{
+				{Key: "input", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$genres", bson.A{}}}}},
+				{Key: "in", Value: bson.D{{Key: "$toLower", Value: "$$this"}}},
+			}}},
+			bson.A{},
+		}}}}}}},
+		bson.D{{Key: "$unwind", Value: "$value"}},
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$value"}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
+	}
+
+	// the same as the service filter, a title is only on a service with an id
+	services := m.countKeys("services", bson.D{{Key: "value.v.id", Value: bson.D{{Key: "$exists", Value: true}}}})
+	scoreKinds := m.countKeys("scores", bson.D{})
+
+	years := bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "year", Value: bson.D{{Key: "$nin", Value: bson.A{0, nil}}}}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "min", Value: bson.D{{Key: "$min", Value: "$year"}}},
+			{Key: "max", Value: bson.D{{Key: "$max", Value: "$year"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filters}},
+		{{Key: "$facet", Value: bson.D{
+			{Key: "total", Value: bson.A{bson.D{{Key: "$count", Value: "count"}}}},
+			{Key: "genres", Value: genres},
+			{Key: "services", Value: services},
+			{Key: "scoreKinds", Value: scoreKinds},
+			{Key: "years", Value: years},
+		}}},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.OperationTimeout)
+	defer cancel()
+
+	cursor, err := m.titles.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate facets: %s", err)
+	}
+
+	var results []mongoFacets
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to read cursor from facets aggregation: %s", err)
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("expected 1 result from facets aggregation, got: %d", len(results))
+	}
+
+	result := results[0]
+	facets := &Facets{
+		Genres:     result.Genres.facetCounts(),
+		Services:   result.Services.facetCounts(),
+		ScoreKinds: result.ScoreKinds.facetCounts(),
+	}
+	if len(result.Total) > 0 {
+		facets.Total = result.Total[0].Count
+	}
+	if len(result.Years) > 0 {
+		facets.Years = result.Years[0]
+	}
+
+	return facets, nil
+}
+
+// countKeys is a pipeline counting the titles with each key of an embedded document e.g. scores
+// match filters the keys, as {k: <key>, v: <value>} documents in the 'value' field
+func (m *MongoStore) countKeys(field string, match bson.D) bson.A {
+	return bson.A{
+		bson.D{{Key: "$project", Value: bson.D{{Key: "value", Value: bson.D{{Key: "$objectToArray", Value: bson.D{
+			{Key: "$ifNull", Value: bson.A{"$" + field, bson.D{}}},
+		}}}}}}},
+		bson.D{{Key: "$unwind", Value: "$value"}},
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$value.k"}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
+	}
+}
+
+// EachTitle iterates a cursor over every title, ordered by 'highest' ID first
+// note: the operation timeout isn't used, as iterating every title can take much longer than a single operation
+func (m *MongoStore) EachTitle(ctx context.Context, fn func(t *title.Title) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}})
+
+	cursor, err := m.titles.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get titles: %s", err)
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var t *title.Title
+		if err := cursor.Decode(&t); err != nil {
+			return fmt.Errorf("failed to decode title: %s", err)
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
 }
 
 func (m *MongoStore) parseFilters(titleFilters ...title.Filter) ([]bson.E, error) {
@@ -255,42 +1167,103 @@ func (m *MongoStore) parseFilters(titleFilters ...title.Filter) ([]bson.E, error
 func (m *MongoStore) parseFilter(tf title.Filter) (bson.E, error) {
 
 	var filter bson.E
+	var err error
 
 	switch tf.(type) {
 	case title.OnServiceFilter:
-		filter = m.onService(tf.(title.OnServiceFilter).Service)
+		filter = m.onService(tf.(title.OnServiceFilter).Services...)
 	case title.IsGenreFilter:
 		filter = m.isGenre(tf.(title.IsGenreFilter).Genres...)
+	case title.ExcludeGenresFilter:
+		filter = m.excludeGenres(tf.(title.ExcludeGenresFilter).Genres...)
 	case title.ScoreBetweenFilter:
 		f := tf.(title.ScoreBetweenFilter)
 		filter = m.scoreBetween(f.Kind, f.Min, f.Max)
+	case title.YearBetweenFilter:
+		f := tf.(title.YearBetweenFilter)
+		filter = m.yearBetween(f.Min, f.Max)
+	case title.ExcludeIDsFilter:
+		filter = m.excludeIDs(tf.(title.ExcludeIDsFilter).IDs...)
+	case title.AndFilter:
+		filter, err = m.logical("$and", tf.(title.AndFilter).Filters...)
+	case title.OrFilter:
+		filter, err = m.logical("$or", tf.(title.OrFilter).Filters...)
+	case title.NotFilter:
+		// $nor with a single expression is the negation of that expression
+		filter, err = m.logical("$nor", tf.(title.NotFilter).Filter)
 	default:
 		return bson.E{}, fmt.Errorf("unsupported title filter type: %s", reflect.TypeOf(tf))
 	}
 
-	return filter, nil
+	return filter, err
 }
 
-func (m *MongoStore) onService(name string) bson.E {
-	if name == "" {
+// logical combines the filters with a logical query operator, e.g. $and
+func (m *MongoStore) logical(operator string, titleFilters ...title.Filter) (bson.E, error) {
+
+	if len(titleFilters) == 0 {
+		return m.emptyFilter(), nil
+	}
+
+	expressions := bson.A{}
+	for _, tf := range titleFilters {
+		f, err := m.parseFilter(tf)
+		if err != nil {
+			return bson.E{}, err
+		}
+
+		// an empty filter matches everything, which is an empty document
+		if f.Key == "" {
+			expressions = append(expressions, bson.D{})
+		} else {
+			expressions = append(expressions, bson.D{f})
+		}
+	}
+
+	return bson.E{Key: operator, Value: expressions}, nil
+}
+
+func (m *MongoStore) onService(names ...string) bson.E {
+	names = nonEmpty(names)
+	if len(names) == 0 {
 		return m.emptyFilter()
 	}
 
-	serviceID := fmt.Sprintf("services.%s.id", name)
+	exists := bson.A{}
+	for _, name := range names {
+		serviceID := fmt.Sprintf("services.%s.id", name)
 
-	return bson.E{Key: serviceID, Value: bson.D{
-		{Key: "$exists", Value: true},
-	}}
+		exists = append(exists, bson.D{{Key: serviceID, Value: bson.D{
+			{Key: "$exists", Value: true},
+		}}})
+	}
+
+	if len(exists) == 1 {
+		return exists[0].(bson.D)[0]
+	}
+	return bson.E{Key: "$or", Value: exists}
 }
 
 func (m *MongoStore) isGenre(names ...string) bson.E {
 
-	if names == nil {
+	if len(names) == 0 {
 		return m.emptyFilter()
 	}
 
-	return bson.E{Key: "genres", Value: bson.D{
-		{Key: "$all", Value: names},
+	return bson.E{Key: lowerGenresField, Value: bson.D{
+		{Key: "$all", Value: lowerCase(names)},
+	}}
+}
+
+func (m *MongoStore) excludeGenres(names ...string) bson.E {
+	names = nonEmpty(names)
+	if len(names) == 0 {
+		return m.emptyFilter()
+	}
+
+	// genres are matched in lower case, in the same way as MemStore
+	return bson.E{Key: lowerGenresField, Value: bson.D{
+		{Key: "$nin", Value: lowerCase(names)},
 	}}
 }
 
@@ -311,6 +1284,32 @@ func (m *MongoStore) scoreBetween(kind string, min int, max int) bson.E {
 	}}
 }
 
+func (m *MongoStore) yearBetween(min int, max int) bson.E {
+
+	if min == 0 && max == 0 {
+		return m.emptyFilter()
+	}
+	if max == 0 {
+		max = math.MaxInt64
+	}
+
+	return bson.E{Key: "year", Value: bson.D{
+		{Key: "$gte", Value: min},
+		{Key: "$lte", Value: max},
+	}}
+}
+
+func (m *MongoStore) excludeIDs(ids ...string) bson.E {
+
+	if len(ids) == 0 {
+		return m.emptyFilter()
+	}
+
+	return bson.E{Key: "_id", Value: bson.D{
+		{Key: "$nin", Value: ids},
+	}}
+}
+
 func (m *MongoStore) emptyFilter() bson.E {
 	return bson.E{}
 }
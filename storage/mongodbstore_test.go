@@ -0,0 +1,39 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/microhod/randflix-api/config"
+	"github.com/microhod/randflix-api/storage"
+	"github.com/microhod/randflix-api/storage/storagetest"
+)
+
+// TestMongoStore runs the conformance suite against the mongod at RANDFLIXAPI_MONGOSTORE_URI, skipping if there isn't one
+// titles are written to the randflix_test database (unless RANDFLIXAPI_MONGOSTORE_DATABASE is set) and removed before each test
+func TestMongoStore(t *testing.T) {
+	if os.Getenv("RANDFLIXAPI_MONGOSTORE_URI") == "" {
+		t.Skip("RANDFLIXAPI_MONGOSTORE_URI is not set")
+	}
+	if os.Getenv("RANDFLIXAPI_MONGOSTORE_DATABASE") == "" {
+		setenv(t, "RANDFLIXAPI_MONGOSTORE_DATABASE", "randflix_test")
+	}
+
+	c := &storage.Config{Config: config.Config{StorageKind: "MongoStore"}}
+
+	// check mongod is available once, rather than waiting for every test to time out
+	s, err := c.NewMongoStore()
+	if err != nil {
+		t.Skipf("mongodb is not available: %s", err)
+	}
+	s.Disconnect()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := c.NewMongoStore()
+		if err != nil {
+			t.Fatalf("NewMongoStore() error: %s", err)
+		}
+		deleteAllTitles(t, s)
+		return s
+	})
+}
@@ -0,0 +1,906 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+const (
+	// postgres error code for unique_violation
+	pqUniqueViolation = "23505"
+
+	titleColumns = "id, name, year, description, genres, scores, poster, directories, services, revision"
+
+	// updateTitleQuery replaces every column and increments the revision, with arguments from titleArgs
+	// where the last argument is the revision expected (or AnyRevision)
+	updateTitleQuery = `UPDATE titles SET
+		name = $2, year = $3, description = $4, genres = $5, scores = $6, poster = $7, directories = $8, services = $9,
+		revision = revision + 1
+		WHERE id = $1 AND ($10::bigint = -1 OR revision = $10::bigint)
+		RETURNING revision`
+
+	// upsertTitleQuery adds or replaces a title, with arguments from titleArgs
+	// xmax is only zero for a newly inserted row
+	upsertTitleQuery = `INSERT INTO titles (` + titleColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET
+		name = EXCLUDED.name, year = EXCLUDED.year, description = EXCLUDED.description, genres = EXCLUDED.genres,
+		scores = EXCLUDED.scores, poster = EXCLUDED.poster, directories = EXCLUDED.directories, services = EXCLUDED.services,
+		revision = titles.revision + 1
+		RETURNING revision, xmax = 0`
+
+	// insertTitleQuery adds a title if it doesn't already exist, with arguments from titleArgs
+	insertTitleQuery = `INSERT INTO titles (` + titleColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO NOTHING
+		RETURNING revision, TRUE`
+)
+
+// postgresMigrations are applied in order on startup, each one exactly once
+// note: never edit or remove a migration, only append new ones
+var postgresMigrations = []string{
+	`CREATE TABLE titles (
+		id          text PRIMARY KEY,
+		name        text NOT NULL DEFAULT '',
+		year        integer NOT NULL DEFAULT 0,
+		description text NOT NULL DEFAULT '',
+		genres      text[],
+		scores      jsonb,
+		poster      text NOT NULL DEFAULT '',
+		directories jsonb,
+		services    jsonb
+	)`,
+	`ALTER TABLE titles ADD COLUMN revision bigint NOT NULL DEFAULT 0`,
+}
+
+// PostgresStore is storage using postgresql
+type PostgresStore struct {
+	db     *sql.DB
+	config *postgresConfig
+}
+
+type postgresConfig struct {
+	URI              string        `required:"true"`
+	OperationTimeout time.Duration `default:"10s"`
+	MaxOpenConns     int           `default:"10"`
+}
+
+func (c *postgresConfig) String() string {
+	// get copy of instance so that we don't override the URI in the real config
+	conf := *c
+
+	conf.URI = maskPassword(conf.URI)
+
+	s, _ := json.MarshalIndent(conf, "", "\t")
+	return string(s)
+}
+
+// postgresQuery builds up a where clause and its positional arguments
+type postgresQuery struct {
+	clauses []string
+	args    []interface{}
+}
+
+// NewPostgresStore connects to postgres and migrates the schema, based on the config passed in
+func (c *Config) NewPostgresStore() (Storage, error) {
+
+	var pConfig postgresConfig
+	err := c.ProcessStorageConfig(&pConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load postgres config: %s", err)
+	}
+	pc := &pConfig
+
+	log.Printf("postgres config: %s\n", pc.String())
+
+	db, err := sql.Open("postgres", pc.URI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create postgres client: %s", err)
+	}
+	db.SetMaxOpenConns(pc.MaxOpenConns)
+	// remove URI after use (as it may include passwords)
+	pc.URI = "REDACTED"
+
+	p := &PostgresStore{
+		db:     db,
+		config: pc,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pc.OperationTimeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping postgres: %s", err)
+	}
+	if err := p.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate postgres schema: %s", err)
+	}
+	log.Printf("(storage): initiated connection to postgres")
+
+	return p, nil
+}
+
+// migrate applies any migrations which have not yet been applied to the database
+func (p *PostgresStore) migrate(ctx context.Context) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %s", err)
+	}
+	// stop multiple instances from migrating at the same time
+	_, err = tx.ExecContext(ctx, `LOCK TABLE schema_migrations IN EXCLUSIVE MODE`)
+	if err != nil {
+		return fmt.Errorf("failed to lock schema_migrations table: %s", err)
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to get current schema version: %s", err)
+	}
+
+	for ; version < len(postgresMigrations); version++ {
+		log.Printf("(storage): applying postgres migration %d", version+1)
+
+		if _, err := tx.ExecContext(ctx, postgresMigrations[version]); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %s", version+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version+1); err != nil {
+			return fmt.Errorf("failed to record migration %d: %s", version+1, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Disconnect closes all connections to postgres
+func (p *PostgresStore) Disconnect() {
+	if err := p.db.Close(); err != nil {
+		log.Printf("ERROR: failed to disconnect from postgres: %s", err)
+	}
+}
+
+// RandomTitle picks a random title based on the filters passed in
+func (p *PostgresStore) RandomTitle(ctx context.Context, titleFilters ...title.Filter) (*title.Title, error) {
+	titles, err := p.RandomTitles(ctx, 1, titleFilters...)
+	if err != nil || len(titles) == 0 {
+		return nil, err
+	}
+
+	return titles[0], nil
+}
+
+// RandomTitles picks up to count distinct random titles based on the filters passed in
+func (p *PostgresStore) RandomTitles(ctx context.Context, count int, titleFilters ...title.Filter) ([]*title.Title, error) {
+
+	q, err := p.parseFilters(titleFilters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filters: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf("SELECT %s FROM titles%s ORDER BY random() LIMIT %s", titleColumns, q.where(), q.arg(count))
+
+	rows, err := p.db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample: %s", err)
+	}
+
+	return scanTitles(rows)
+}
+
+// SampleTitles picks up to opts.Count distinct titles, with probability proportional to their weight
+// titles are ordered by a random key for their weight (see sampleTitles), so only the titles chosen are returned
+func (p *PostgresStore) SampleTitles(ctx context.Context, opts SampleOptions) ([]*title.Title, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Weight.Kind == Uniform && opts.Seed == "" {
+		return p.RandomTitles(ctx, opts.Count, opts.Filters...)
+	}
+
+	q, err := p.parseFilters(opts.Filters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filters: %s", err)
+	}
+
+	weight := "1"
+	switch opts.Weight.Kind {
+	case ScoreWeight:
+		weight = fmt.Sprintf("(scores->>%s::text)::float8", q.arg(opts.Weight.ScoreKind))
+		q.clauses = append(q.clauses, fmt.Sprintf("(scores->>%s::text)::bigint > 0", q.arg(opts.Weight.ScoreKind)))
+	case RecencyWeight:
+		weight = fmt.Sprintf("power(0.5, GREATEST(%s::integer - year, 0) / %s::float8)", q.arg(time.Now().Year()), q.arg(recencyHalfLife))
+	}
+
+	// random() is in [0, 1), so 1 - random() is never 0
+	uniform := "(1 - random())"
+	if opts.Seed != "" {
+		// the same as seededUniform, where idHash is the first 8 hex digits (32 bits) of the md5 hash of the id
+		modulus := q.arg(int64(seedModulus))
+		hash := fmt.Sprintf(`(('x' || substr(md5(id), 1, 8))::bit(32)::bigint %% %s::bigint)`, modulus)
+
+		coefficients := seedCoefficients(opts.Seed)
+		v := fmt.Sprintf("%s::bigint", q.arg(coefficients[0]))
+		for _, c := range coefficients[1:] {
+			v = fmt.Sprintf("((%s * %s + %s::bigint) %% %s::bigint)", v, hash, q.arg(c), modulus)
+		}
+		uniform = fmt.Sprintf("((%s + 1)::float8 / %s::float8)", v, modulus)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`SELECT %s FROM titles%s ORDER BY ln(%s) / %s DESC, id COLLATE "C" LIMIT %s`,
+		titleColumns, q.where(), uniform, weight, q.arg(opts.Count))
+
+	rows, err := p.db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample: %s", err)
+	}
+
+	return scanTitles(rows)
+}
+
+// AddTitle adds the title passed in
+func (p *PostgresStore) AddTitle(ctx context.Context, t *title.Title) (*title.Title, error) {
+	t = withRevision(t, 1)
+	args, err := titleArgs(t)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf("INSERT INTO titles (%s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", titleColumns)
+
+	_, err = p.db.ExecContext(ctx, query, args...)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation {
+		return nil, fmt.Errorf("%w with id: '%s'", ErrAlreadyExists, t.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// UpdateTitle replaces the title passed in, if it's still at the revision expected
+func (p *PostgresStore) UpdateTitle(ctx context.Context, t *title.Title, revision int) (*title.Title, error) {
+	args, err := titleArgs(t)
+	if err != nil {
+		return nil, err
+	}
+	args[len(args)-1] = revision
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	var updated int
+	err = p.db.QueryRowContext(ctx, updateTitleQuery, args...).Scan(&updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, p.notUpdated(ctx, t.ID, revision)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return withRevision(t, updated), nil
+}
+
+// notUpdated works out why a title wasn't updated, it either doesn't exist or is at a different revision
+func (p *PostgresStore) notUpdated(ctx context.Context, id string, revision int) error {
+	existing, err := p.GetTitle(ctx, id)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
+	if err := checkRevision(existing, revision); err != nil {
+		return err
+	}
+
+	// the title was changed again, back to the revision expected
+	return fmt.Errorf("%w with id: '%s'", ErrConflict, id)
+}
+
+// PatchTitle applies the merge patch to the title, locking its row while it does so
+func (p *PostgresStore) PatchTitle(ctx context.Context, id string, patch []byte, revision int) (*title.Title, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("SELECT %s FROM titles WHERE id = $1 FOR UPDATE", titleColumns)
+
+	existing, err := scanTitle(tx.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRevision(existing, revision); err != nil {
+		return nil, err
+	}
+
+	patched, err := applyPatch(existing, patch)
+	if err != nil {
+		return nil, err
+	}
+	args, err := titleArgs(patched)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated int
+	if err := tx.QueryRowContext(ctx, updateTitleQuery, args...).Scan(&updated); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return withRevision(patched, updated), nil
+}
+
+// BulkUpsert writes all the titles in a single transaction, with one prepared statement
+func (p *PostgresStore) BulkUpsert(ctx context.Context, titles []*title.Title, mode BulkMode) ([]BulkResult, error) {
+	query := upsertTitleQuery
+	if mode == InsertOnly {
+		query = insertTitleQuery
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	results := make([]BulkResult, len(titles))
+	for i, t := range titles {
+		args, err := titleArgs(withRevision(t, 1))
+		if err != nil {
+			results[i] = BulkResult{Err: err}
+			continue
+		}
+
+		var revision int
+		var created bool
+		err = stmt.QueryRowContext(ctx, args...).Scan(&revision, &created)
+		if errors.Is(err, sql.ErrNoRows) {
+			results[i] = BulkResult{Err: fmt.Errorf("%w with id: '%s'", ErrAlreadyExists, t.ID)}
+			continue
+		}
+		if err != nil {
+			// any other error aborts the transaction
+			return nil, fmt.Errorf("failed to write title '%s': %s", t.ID, err)
+		}
+
+		results[i] = BulkResult{Title: withRevision(t, revision), Created: created}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// GetTitle gets a single title by id, if it doesn't exist, it returns nil
+func (p *PostgresStore) GetTitle(ctx context.Context, id string) (*title.Title, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf("SELECT %s FROM titles WHERE id = $1", titleColumns)
+
+	t, err := scanTitle(p.db.QueryRowContext(ctx, query, id))
+	// we don't want to return an error if the title was not found
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return t, err
+}
+
+// DeleteTitle deletes a single title by id
+func (p *PostgresStore) DeleteTitle(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	result, err := p.db.ExecContext(ctx, `DELETE FROM titles WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w with id: '%s'", ErrNotFound, id)
+	}
+
+	return nil
+}
+
+// ListTitles lists a page of titles, ordered by the sort fields and then 'highest' ID first
+func (p *PostgresStore) ListTitles(ctx context.Context, opts ListOptions) (*TitlePage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	q, err := p.parseFilters(opts.Filters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filters: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	var total int
+	if err := p.db.QueryRowContext(ctx, "SELECT count(*) FROM titles"+q.where(), q.args...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("failed to count titles: %s", err)
+	}
+
+	offset := opts.Page * opts.PageSize
+	if opts.After != "" {
+		q.clauses = append(q.clauses, fmt.Sprintf(`id COLLATE "C" < %s::text`, q.arg(opts.After)))
+		offset = 0
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM titles%s ORDER BY %s LIMIT %s OFFSET %s`,
+		titleColumns, q.where(), p.orderBy(q, opts.Sort), q.arg(opts.PageSize), q.arg(offset))
+
+	rows, err := p.db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page %d of titles with a page size of %d: %s", opts.Page, opts.PageSize, err)
+	}
+
+	titles, err := scanTitles(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TitlePage{Titles: titles, Total: total}, nil
+}
+
+// orderBy converts the sort fields to an order by clause, ending with 'highest' ID first
+// text is ordered by bytes (rather than the database locale), so that ordering is the same as other storage
+func (p *PostgresStore) orderBy(q *postgresQuery, fields []SortField) string {
+	order := []string{}
+	for _, f := range fields {
+		var expression string
+		switch f.Field {
+		case "id":
+			expression = `id COLLATE "C"`
+		case "name":
+			expression = `name COLLATE "C"`
+		case "year":
+			expression = "year"
+		default:
+			expression = fmt.Sprintf("(scores->>%s::text)::bigint", q.arg(scoreKind(f.Field)))
+		}
+
+		// missing scores sort before all others
+		if f.Descending {
+			order = append(order, expression+" DESC NULLS LAST")
+		} else {
+			order = append(order, expression+" ASC NULLS FIRST")
+		}
+	}
+
+	return strings.Join(append(order, `id COLLATE "C" DESC`), ", ")
+}
+
+// CountTitles counts the titles passing the filters
+func (p *PostgresStore) CountTitles(ctx context.Context, titleFilters ...title.Filter) (int, error) {
+	q, err := p.parseFilters(titleFilters...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse filters: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	var count int
+	if err := p.db.QueryRowContext(ctx, "SELECT count(*) FROM titles"+q.where(), q.args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count titles: %s", err)
+	}
+
+	return count, nil
+}
+
+// SearchTitles finds up to limit titles matching the query
+// word boundary regexes find titles with every word (the last as a prefix), which are then ranked
+// candidates are ordered by a rank weighted in the same way as searchScore (then id), so that when there are more than
+// maxSearchCandidates, the best matches are still ranked
+func (p *PostgresStore) SearchTitles(ctx context.Context, query string, limit int) ([]*title.Title, error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return []*title.Title{}, nil
+	}
+
+	q := &postgresQuery{}
+	ranks := []string{}
+	for i, word := range words {
+		// words are only letters and numbers, so don't need escaping
+		whole := q.arg(`\m` + word + `\M`)
+		match := whole
+		prefix := "NULL"
+		if i == len(words)-1 {
+			prefix = q.arg(`\m` + word)
+			match = prefix
+		}
+
+		q.clauses = append(q.clauses, fmt.Sprintf("(name ~* %s::text OR description ~* %s::text)", match, match))
+		for _, field := range []struct {
+			column string
+			weight float64
+		}{{"name", nameSearchWeight}, {"description", descriptionSearchWeight}} {
+			ranks = append(ranks, fmt.Sprintf("CASE WHEN %s ~* %s::text THEN %g WHEN %s ~* %s::text THEN %g ELSE 0 END",
+				field.column, whole, field.weight, field.column, prefix, field.weight*prefixSearchWeight))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	statement := fmt.Sprintf("SELECT %s FROM titles%s ORDER BY %s DESC, id LIMIT %s",
+		titleColumns, q.where(), strings.Join(ranks, " + "), q.arg(maxSearchCandidates))
+	rows, err := p.db.QueryContext(ctx, statement, q.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search titles: %s", err)
+	}
+
+	candidates, err := scanTitles(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return rankTitles(candidates, words, limit), nil
+}
+
+// facetsQuery counts the values of every facet in a single statement, as rows of (facet, value, count)
+// %s is the where clause for the filters, and jsonb columns which are null (rather than objects) are treated as empty
+const facetsQuery = `WITH filtered AS (SELECT id, year, genres, scores, services FROM titles%s)
+	SELECT 'total', '', count(*) FROM filtered
+	UNION ALL
+	SELECT 'genres', lower(g), count(DISTINCT id) FROM filtered, unnest(genres) g GROUP BY lower(g)
+	UNION ALL
+	SELECT 'services', s.key, count(*)
+		FROM filtered, jsonb_each(CASE WHEN jsonb_typeof(services) = 'object' THEN services ELSE '{}' END) s
+		WHERE COALESCE(s.value->>'url', '') <> '' GROUP BY s.key
+	UNION ALL
+	SELECT 'scoreKinds', k, count(*)
+		FROM filtered, jsonb_object_keys(CASE WHEN jsonb_typeof(scores) = 'object' THEN scores ELSE '{}' END) k GROUP BY k
+	UNION ALL
+	SELECT 'yearMin', '', COALESCE(min(year), 0) FROM filtered WHERE year <> 0
+	UNION ALL
+	SELECT 'yearMax', '', COALESCE(max(year), 0) FROM filtered WHERE year <> 0
+	UNION ALL
+	SELECT 'yearCount', '', count(*) FROM filtered WHERE year <> 0`
+
+// Facets summarises the titles passing the filters
+func (p *PostgresStore) Facets(ctx context.Context, titleFilters ...title.Filter) (*Facets, error) {
+	q, err := p.parseFilters(titleFilters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse filters: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.OperationTimeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(facetsQuery, q.where()), q.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count facets: %s", err)
+	}
+	defer rows.Close()
+
+	facets := &Facets{}
+	counts := map[string]map[string]int{"genres": {}, "services": {}, "scoreKinds": {}}
+	for rows.Next() {
+		var facet, value string
+		var count int
+		if err := rows.Scan(&facet, &value, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan facet: %s", err)
+		}
+
+		switch facet {
+		case "total":
+			facets.Total = count
+		case "yearMin":
+			facets.Years.Min = count
+		case "yearMax":
+			facets.Years.Max = count
+		case "yearCount":
+			facets.Years.Count = count
+		default:
+			counts[facet][value] = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read facets: %s", err)
+	}
+
+	facets.Genres = facetCounts(counts["genres"])
+	facets.Services = facetCounts(counts["services"])
+	facets.ScoreKinds = facetCounts(counts["scoreKinds"])
+
+	return facets, nil
+}
+
+// EachTitle streams every title from a single query, ordered by 'highest' ID first
+// note: the operation timeout isn't used, as streaming every title can take much longer than a single operation
+func (p *PostgresStore) EachTitle(ctx context.Context, fn func(t *title.Title) error) error {
+	query := fmt.Sprintf(`SELECT %s FROM titles ORDER BY id COLLATE "C" DESC`, titleColumns)
+
+	rows, err := p.db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to get titles: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanTitle(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan title: %s", err)
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (p *PostgresStore) parseFilters(titleFilters ...title.Filter) (*postgresQuery, error) {
+
+	q := &postgresQuery{}
+
+	for _, tf := range titleFilters {
+		if err := p.parseFilter(q, tf); err != nil {
+			return nil, fmt.Errorf("failed to parse filter: %s", err)
+		}
+	}
+
+	return q, nil
+}
+
+func (p *PostgresStore) parseFilter(q *postgresQuery, tf title.Filter) error {
+
+	switch tf.(type) {
+	case title.OnServiceFilter:
+		p.onService(q, tf.(title.OnServiceFilter).Services...)
+	case title.IsGenreFilter:
+		p.isGenre(q, tf.(title.IsGenreFilter).Genres...)
+	case title.ExcludeGenresFilter:
+		p.excludeGenres(q, tf.(title.ExcludeGenresFilter).Genres...)
+	case title.ScoreBetweenFilter:
+		f := tf.(title.ScoreBetweenFilter)
+		p.scoreBetween(q, f.Kind, f.Min, f.Max)
+	case title.YearBetweenFilter:
+		f := tf.(title.YearBetweenFilter)
+		p.yearBetween(q, f.Min, f.Max)
+	case title.ExcludeIDsFilter:
+		p.excludeIDs(q, tf.(title.ExcludeIDsFilter).IDs...)
+	case title.AndFilter:
+		return p.logical(q, "AND", tf.(title.AndFilter).Filters...)
+	case title.OrFilter:
+		return p.logical(q, "OR", tf.(title.OrFilter).Filters...)
+	case title.NotFilter:
+		clause, err := p.clause(q, tf.(title.NotFilter).Filter)
+		if err != nil {
+			return err
+		}
+		q.clauses = append(q.clauses, fmt.Sprintf("NOT %s", clause))
+	default:
+		return fmt.Errorf("unsupported title filter type: %s", reflect.TypeOf(tf))
+	}
+
+	return nil
+}
+
+// logical combines the filters with a logical operator, e.g. AND
+func (p *PostgresStore) logical(q *postgresQuery, operator string, titleFilters ...title.Filter) error {
+	if len(titleFilters) == 0 {
+		return nil
+	}
+
+	clauses := []string{}
+	for _, tf := range titleFilters {
+		clause, err := p.clause(q, tf)
+		if err != nil {
+			return err
+		}
+		clauses = append(clauses, clause)
+	}
+
+	q.clauses = append(q.clauses, fmt.Sprintf("(%s)", strings.Join(clauses, fmt.Sprintf(" %s ", operator))))
+	return nil
+}
+
+// clause parses a single filter to a parenthesised clause, sharing the query's arguments
+// a filter with no effect is TRUE
+func (p *PostgresStore) clause(q *postgresQuery, tf title.Filter) (string, error) {
+	sub := &postgresQuery{args: q.args}
+	if err := p.parseFilter(sub, tf); err != nil {
+		return "", err
+	}
+	q.args = sub.args
+
+	if len(sub.clauses) == 0 {
+		return "TRUE", nil
+	}
+	return fmt.Sprintf("(%s)", strings.Join(sub.clauses, " AND ")), nil
+}
+
+func (p *PostgresStore) onService(q *postgresQuery, names ...string) {
+	names = nonEmpty(names)
+	if len(names) == 0 {
+		return
+	}
+
+	clauses := []string{}
+	for _, name := range names {
+		clauses = append(clauses, fmt.Sprintf("COALESCE(services->%s::text->>'url', '') <> ''", q.arg(name)))
+	}
+
+	q.clauses = append(q.clauses, fmt.Sprintf("(%s)", strings.Join(clauses, " OR ")))
+}
+
+func (p *PostgresStore) isGenre(q *postgresQuery, names ...string) {
+	for _, n := range names {
+		q.clauses = append(q.clauses, fmt.Sprintf("lower(%s::text) IN (SELECT lower(g) FROM unnest(genres) g)", q.arg(n)))
+	}
+}
+
+func (p *PostgresStore) excludeGenres(q *postgresQuery, names ...string) {
+	for _, n := range nonEmpty(names) {
+		q.clauses = append(q.clauses, fmt.Sprintf("lower(%s::text) NOT IN (SELECT lower(g) FROM unnest(genres) g)", q.arg(n)))
+	}
+}
+
+func (p *PostgresStore) scoreBetween(q *postgresQuery, kind string, min int, max int) {
+	if kind == "" {
+		return
+	}
+	if max == 0 {
+		max = math.MaxInt64
+	}
+
+	q.clauses = append(q.clauses, fmt.Sprintf("(scores->>%s::text)::bigint BETWEEN %s AND %s",
+		q.arg(kind), q.arg(min), q.arg(max)))
+}
+
+func (p *PostgresStore) yearBetween(q *postgresQuery, min int, max int) {
+	if min == 0 && max == 0 {
+		return
+	}
+	if max == 0 {
+		max = math.MaxInt32
+	}
+
+	q.clauses = append(q.clauses, fmt.Sprintf("year BETWEEN %s AND %s", q.arg(min), q.arg(max)))
+}
+
+func (p *PostgresStore) excludeIDs(q *postgresQuery, ids ...string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	q.clauses = append(q.clauses, fmt.Sprintf("id <> ALL(%s::text[])", q.arg(pq.Array(ids))))
+}
+
+// arg adds a positional argument to the query and returns its placeholder
+func (q *postgresQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// where returns the where clause (ANDing all clauses) or an empty string if there are none
+func (q *postgresQuery) where() string {
+	if len(q.clauses) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.clauses, " AND ")
+}
+
+// titleArgs converts a title to arguments, in the same order as titleColumns
+func titleArgs(t *title.Title) ([]interface{}, error) {
+	scores, err := json.Marshal(t.Scores)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal scores: %s", err)
+	}
+	directories, err := json.Marshal(t.Directories)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal directories: %s", err)
+	}
+	services, err := json.Marshal(t.Services)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal services: %s", err)
+	}
+
+	return []interface{}{
+		// jsonb columns are passed as strings, as []byte would be sent as bytea
+		t.ID, t.Name, t.Year, t.Description, pq.Array(t.Genres), string(scores), t.Poster, string(directories), string(services), t.Revision,
+	}, nil
+}
+
+// scanTitles reads all titles from rows (selected with titleColumns) and closes them
+func scanTitles(rows *sql.Rows) ([]*title.Title, error) {
+	defer rows.Close()
+
+	titles := []*title.Title{}
+	for rows.Next() {
+		t, err := scanTitle(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan title: %s", err)
+		}
+		titles = append(titles, t)
+	}
+
+	return titles, rows.Err()
+}
+
+// scanTitle reads a title from a row, selected with titleColumns
+func scanTitle(row interface{ Scan(...interface{}) error }) (*title.Title, error) {
+	var t title.Title
+	var scores, directories, services []byte
+
+	err := row.Scan(&t.ID, &t.Name, &t.Year, &t.Description, pq.Array(&t.Genres), &scores, &t.Poster, &directories, &services, &t.Revision)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range []struct {
+		raw []byte
+		v   interface{}
+	}{
+		{scores, &t.Scores},
+		{directories, &t.Directories},
+		{services, &t.Services},
+	} {
+		if field.raw == nil {
+			continue
+		}
+		if err := json.Unmarshal(field.raw, field.v); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal title '%s': %s", t.ID, err)
+		}
+	}
+
+	return &t, nil
+}
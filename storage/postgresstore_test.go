@@ -0,0 +1,36 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/microhod/randflix-api/config"
+	"github.com/microhod/randflix-api/storage"
+	"github.com/microhod/randflix-api/storage/storagetest"
+)
+
+// TestPostgresStore runs the conformance suite against the database at RANDFLIXAPI_POSTGRESSTORE_URI, skipping if it isn't set
+// note: every title in the database is removed before each test, so it should be a database just for testing
+func TestPostgresStore(t *testing.T) {
+	if os.Getenv("RANDFLIXAPI_POSTGRESSTORE_URI") == "" {
+		t.Skip("RANDFLIXAPI_POSTGRESSTORE_URI is not set")
+	}
+
+	c := &storage.Config{Config: config.Config{StorageKind: "PostgresStore"}}
+
+	// connecting also applies the migrations, so they are tested once before the suite
+	s, err := c.NewPostgresStore()
+	if err != nil {
+		t.Fatalf("NewPostgresStore() error: %s", err)
+	}
+	s.Disconnect()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := c.NewPostgresStore()
+		if err != nil {
+			t.Fatalf("NewPostgresStore() error: %s", err)
+		}
+		deleteAllTitles(t, s)
+		return s
+	})
+}
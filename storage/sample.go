@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+// WeightKind is what random selection is biased by
+type WeightKind int
+
+const (
+	// Uniform chooses every title with the same probability
+	Uniform WeightKind = iota
+	// ScoreWeight chooses titles with probability proportional to a score
+	// titles without the score (or with a score of 0 or less) are never chosen
+	ScoreWeight
+	// RecencyWeight chooses titles with probability halving for every recencyHalfLife years since their release
+	RecencyWeight
+)
+
+const (
+	// recencyHalfLife is the number of years it takes for a title to become half as likely to be chosen, with RecencyWeight
+	// titles without a year are treated as released in year 0, so are (almost) never chosen
+	recencyHalfLife = 10.0
+
+	// seedModulus is the prime (2^31 - 1) which seeded keys are computed modulo (see seededUniform)
+	// it's small enough that every product fits in a 64 bit integer, so keys can be computed in the same way in a query
+	seedModulus = 1<<31 - 1
+)
+
+// SampleOptions decide how SampleTitles chooses titles
+type SampleOptions struct {
+	// Count is the most titles chosen
+	Count int
+	// Weight biases which titles are chosen, the zero value chooses uniformly
+	Weight Weight
+	// Seed makes the choice deterministic: the same seed chooses the same titles, as long as the titles passing the filters
+	// (and the current year, for RecencyWeight) don't change. With an empty seed, the titles are chosen at random
+	Seed string
+	// Filters restrict the titles chosen from, in the same way as for RandomTitles
+	Filters []title.Filter
+}
+
+// Weight biases random selection, so that titles are chosen with probability proportional to their weight
+type Weight struct {
+	Kind WeightKind
+	// ScoreKind is the kind of score to weight by, for ScoreWeight
+	ScoreKind string
+}
+
+// Validate checks the options can be used to choose titles
+func (opts SampleOptions) Validate() error {
+	if opts.Count < 1 {
+		return fmt.Errorf("count must be at least 1, got: %d", opts.Count)
+	}
+
+	switch opts.Weight.Kind {
+	case Uniform, RecencyWeight:
+		return nil
+	case ScoreWeight:
+		if opts.Weight.ScoreKind == "" {
+			return fmt.Errorf("score weight has no score kind")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported weight kind: %d", opts.Weight.Kind)
+	}
+}
+
+// of is the weight of a title, where titles with a weight of 0 are never chosen
+// year is the current year, for RecencyWeight
+func (w Weight) of(t *title.Title, year int) float64 {
+	switch w.Kind {
+	case ScoreWeight:
+		score, ok := t.Scores[w.ScoreKind]
+		if !ok || score <= 0 {
+			return 0
+		}
+		return float64(score)
+	case RecencyWeight:
+		// titles from the future are as likely as titles from this year
+		age := math.Max(float64(year-t.Year), 0)
+		return math.Pow(0.5, age/recencyHalfLife)
+	default:
+		return 1
+	}
+}
+
+// sampleTitles chooses up to count distinct titles, each with probability proportional to its weight
+// it uses the Efraimidis-Spirakis method: every title gets the key ln(u)/weight (for a random u in (0, 1])
+// and the titles with the largest keys are chosen, which other storage can do in a query
+// with a seed, u comes from the hash of the seed and the title's id (see seededUniform), rather than at random
+func sampleTitles(titles []*title.Title, opts SampleOptions) []*title.Title {
+	year := time.Now().Year()
+
+	type keyed struct {
+		title *title.Title
+		key   float64
+	}
+
+	candidates := []keyed{}
+	for _, t := range titles {
+		weight := opts.Weight.of(t, year)
+		if weight <= 0 {
+			continue
+		}
+
+		// rand.Float64 is in [0, 1), so 1 - u is never 0
+		u := 1 - rand.Float64()
+		if opts.Seed != "" {
+			u = seededUniform(opts.Seed, t.ID)
+		}
+		candidates = append(candidates, keyed{t, math.Log(u) / weight})
+	}
+
+	// ties are broken by id, so that a seed always chooses the same titles
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].key != candidates[j].key {
+			return candidates[i].key > candidates[j].key
+		}
+		return candidates[i].title.ID < candidates[j].title.ID
+	})
+
+	sample := []*title.Title{}
+	for i := 0; i < len(candidates) && i < opts.Count; i++ {
+		sample = append(sample, candidates[i].title)
+	}
+	return sample
+}
+
+// seededUniform is a number in (0, 1], which is always the same for the seed and id
+// but is (in effect) random between different seeds or ids
+// it's a polynomial of the id's hash, with the seed's coefficients, modulo seedModulus (so the numbers for different ids
+// are 4-wise independent). The id's hash can be stored with each title, so queries don't need to hash every id
+func seededUniform(seed string, id string) float64 {
+	coefficients := seedCoefficients(seed)
+	hash := idHash(id)
+
+	v := coefficients[0]
+	for _, c := range coefficients[1:] {
+		v = (v*hash + c) % seedModulus
+	}
+	return float64(v+1) / seedModulus
+}
+
+// seedCoefficients are the coefficients of the polynomial for a seed (see seededUniform), highest power first
+func seedCoefficients(seed string) [4]int64 {
+	sum := md5.Sum([]byte(seed))
+
+	var coefficients [4]int64
+	for i := range coefficients {
+		coefficients[i] = int64(binary.BigEndian.Uint32(sum[i*4:])) % seedModulus
+	}
+	return coefficients
+}
+
+// idHash is the hash of a title's id which its seeded keys are found from (see seededUniform), in [0, seedModulus)
+func idHash(id string) int64 {
+	sum := md5.Sum([]byte(id))
+	return int64(binary.BigEndian.Uint32(sum[:4])) % seedModulus
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/microhod/randflix-api/model/title"
+)
+
+// Search matches the words in a query against the words in each title's name and description
+// every word but the last must match a whole word, and the last may match the start of a word (for autocomplete)
+// titles are ranked by how many (and how well) words match, where words in the name count for more
+
+const (
+	nameSearchWeight        = 3.0
+	descriptionSearchWeight = 1.0
+	// prefixSearchWeight is the fraction of the weight given to a word which only starts with the search word
+	prefixSearchWeight = 0.5
+
+	// maxSearchCandidates is the most titles which storage without an in memory index will rank for a search
+	maxSearchCandidates = 1000
+)
+
+// searchWords splits text into lower case words, on anything which isn't a letter or a number
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchScore scores how well the title matches the search words, 0 means it doesn't match
+func searchScore(t *title.Title, words []string) float64 {
+	fields := []struct {
+		words  []string
+		weight float64
+	}{
+		{searchWords(t.Name), nameSearchWeight},
+		{searchWords(t.Description), descriptionSearchWeight},
+	}
+
+	score := 0.0
+	for i, word := range words {
+		prefix := i == len(words)-1
+
+		wordScore := 0.0
+		for _, f := range fields {
+			for _, w := range f.words {
+				switch {
+				case w == word:
+					wordScore += f.weight
+				case prefix && strings.HasPrefix(w, word):
+					wordScore += f.weight * prefixSearchWeight
+				}
+			}
+		}
+
+		if wordScore == 0 {
+			return 0
+		}
+		score += wordScore
+	}
+
+	return score
+}
+
+// rankTitles returns up to limit of the titles which match the search words, best match first
+// titles which score the same are ordered by name, then id
+func rankTitles(titles []*title.Title, words []string, limit int) []*title.Title {
+	type scored struct {
+		title *title.Title
+		score float64
+	}
+
+	matches := []scored{}
+	for _, t := range titles {
+		if score := searchScore(t, words); score > 0 {
+			matches = append(matches, scored{t, score})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.title.Name != b.title.Name {
+			return a.title.Name < b.title.Name
+		}
+		return a.title.ID < b.title.ID
+	})
+
+	ranked := []*title.Title{}
+	for i := 0; i < len(matches) && i < limit; i++ {
+		ranked = append(ranked, matches[i].title)
+	}
+	return ranked
+}
+
+// searchIndex is an inverted index, from each word to the titles containing it (in their name or description)
+// note: it isn't safe for concurrent use, MemStore only uses it while holding its lock
+type searchIndex struct {
+	// titles maps each word to the ids of the titles containing it
+	titles map[string]map[string]bool
+	// words maps each title id to its words, so they can be removed when the title changes
+	words map[string][]string
+	// sorted is every word in order, for finding words by prefix (nil if it needs to be rebuilt)
+	sorted []string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		titles: map[string]map[string]bool{},
+		words:  map[string][]string{},
+	}
+}
+
+// add indexes the title, replacing any previous version of it
+func (i *searchIndex) add(t *title.Title) {
+	i.remove(t.ID)
+
+	seen := map[string]bool{}
+	for _, w := range append(searchWords(t.Name), searchWords(t.Description)...) {
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+
+		if i.titles[w] == nil {
+			i.titles[w] = map[string]bool{}
+			i.sorted = nil
+		}
+		i.titles[w][t.ID] = true
+		i.words[t.ID] = append(i.words[t.ID], w)
+	}
+}
+
+// remove removes the title from the index
+func (i *searchIndex) remove(id string) {
+	for _, w := range i.words[id] {
+		delete(i.titles[w], id)
+		if len(i.titles[w]) == 0 {
+			delete(i.titles, w)
+			i.sorted = nil
+		}
+	}
+	delete(i.words, id)
+}
+
+// candidates finds the ids of the titles containing every search word (the last as a prefix)
+func (i *searchIndex) candidates(words []string) map[string]bool {
+	var ids map[string]bool
+
+	for n, word := range words {
+		matching := map[string]bool{}
+		if n == len(words)-1 {
+			for _, w := range i.prefixed(word) {
+				for id := range i.titles[w] {
+					matching[id] = true
+				}
+			}
+		} else {
+			for id := range i.titles[word] {
+				matching[id] = true
+			}
+		}
+
+		if ids == nil {
+			ids = matching
+			continue
+		}
+		for id := range ids {
+			if !matching[id] {
+				delete(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+// prefixed finds every indexed word starting with the prefix
+func (i *searchIndex) prefixed(prefix string) []string {
+	if i.sorted == nil {
+		i.sorted = make([]string, 0, len(i.titles))
+		for w := range i.titles {
+			i.sorted = append(i.sorted, w)
+		}
+		sort.Strings(i.sorted)
+	}
+
+	words := []string{}
+	for n := sort.SearchStrings(i.sorted, prefix); n < len(i.sorted) && strings.HasPrefix(i.sorted[n], prefix); n++ {
+		words = append(words, i.sorted[n])
+	}
+	return words
+}
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/kelseyhightower/envconfig"
@@ -11,20 +13,96 @@ import (
 	"github.com/microhod/randflix-api/model/title"
 )
 
+// AnyRevision can be passed to UpdateTitle and PatchTitle to write a title whatever its current revision is
+const AnyRevision = -1
+
+// ListOptions chooses the page of titles returned by ListTitles
+type ListOptions struct {
+	PageSize int
+	// Page is zero indexed, and ignored if After is set
+	Page int
+	// After is the id of the last title on the previous page, for cursor based paging
+	// unlike Page, titles added or removed before the cursor don't shift the titles on later pages
+	// note: After can only be used with the default order
+	After string
+	// Filters restrict the titles listed, in the same way as for RandomTitles
+	Filters []title.Filter
+	// Sort orders titles by each field in turn, then by 'highest' ID first
+	Sort []SortField
+}
+
+// SortField orders titles by a field, one of "id", "name", "year" or "scores.<kind>"
+// titles without the score sort before all others (i.e. first when ascending, last when descending)
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// TitlePage is a page of titles from ListTitles
+type TitlePage struct {
+	Titles []*title.Title
+	// Total is the number of titles matching the filters (not only those after the cursor)
+	Total int
+}
+
+// BulkMode decides what BulkUpsert does with titles which already exist
+type BulkMode int
+
+const (
+	// Upsert adds titles which don't exist and replaces those which do
+	Upsert BulkMode = iota
+	// InsertOnly adds titles which don't exist, any which do fail with ErrAlreadyExists
+	InsertOnly
+)
+
+// BulkResult is the outcome of writing a single title with BulkUpsert
+type BulkResult struct {
+	// Title is the title as written (nil if it failed)
+	Title *title.Title
+	// Created is true if the title was added, rather than replaced
+	Created bool
+	Err     error
+}
+
 // Storage provides storage functions for the api
+// every operation should stop (returning an error) when ctx is done
+// every write sets the title's revision, starting at 1 when it's added and incrementing on each update
 type Storage interface {
 	// Disconnect disconnects from the storage
 	Disconnect()
 	// RandomTitle gets a random title from storage
-	RandomTitle(filters ...title.Filter) (*title.Title, error)
-	// AddTitle adds a title to storage
-	AddTitle(t *title.Title) (*title.Title, error)
-	// UpdateTitle replaces a title in storage
-	UpdateTitle(t *title.Title) (*title.Title, error)
-	// GetTitle retrieves a title from storage by id
-	GetTitle(id string) (*title.Title, error)
-	// ListTitles retrieves all titles from storage
-	ListTitles(pageSize int, page int) ([]*title.Title, error)
+	RandomTitle(ctx context.Context, filters ...title.Filter) (*title.Title, error)
+	// RandomTitles gets up to count distinct random titles from storage
+	RandomTitles(ctx context.Context, count int, filters ...title.Filter) ([]*title.Title, error)
+	// SampleTitles gets up to opts.Count distinct random titles from storage, with probability proportional to their weight
+	// and the same titles every time for the same (non empty) seed
+	SampleTitles(ctx context.Context, opts SampleOptions) ([]*title.Title, error)
+	// AddTitle adds a title to storage, returning ErrAlreadyExists if the id is taken
+	AddTitle(ctx context.Context, t *title.Title) (*title.Title, error)
+	// UpdateTitle replaces a title in storage, returning ErrNotFound if it doesn't exist
+	// and ErrConflict if revision isn't AnyRevision and doesn't match the stored revision
+	UpdateTitle(ctx context.Context, t *title.Title, revision int) (*title.Title, error)
+	// GetTitle retrieves a title from storage by id, returning nil if it doesn't exist
+	GetTitle(ctx context.Context, id string) (*title.Title, error)
+	// PatchTitle atomically applies a JSON merge patch (RFC 7396) to a title, returning ErrNotFound if it doesn't exist
+	// and ErrConflict if revision isn't AnyRevision and doesn't match the stored revision
+	PatchTitle(ctx context.Context, id string, patch []byte, revision int) (*title.Title, error)
+	// BulkUpsert writes many titles at once, returning a result for each title in the same order
+	// an error is only returned if the whole batch failed
+	BulkUpsert(ctx context.Context, titles []*title.Title, mode BulkMode) ([]BulkResult, error)
+	// DeleteTitle removes a title from storage by id, returning ErrNotFound if it doesn't exist
+	DeleteTitle(ctx context.Context, id string) error
+	// ListTitles retrieves a page of titles from storage, ordered by 'highest' ID first
+	ListTitles(ctx context.Context, opts ListOptions) (*TitlePage, error)
+	// CountTitles counts the titles passing the filters, the same titles RandomTitles chooses from
+	CountTitles(ctx context.Context, filters ...title.Filter) (int, error)
+	// SearchTitles finds up to limit titles whose name or description match the query, best match first
+	SearchTitles(ctx context.Context, query string, limit int) ([]*title.Title, error)
+	// Facets summarises the distinct values (and year range) of the titles passing the filters
+	Facets(ctx context.Context, filters ...title.Filter) (*Facets, error)
+	// EachTitle calls fn with every title in storage (in the same order as ListTitles), stopping at the first error
+	// titles are streamed, so the whole catalogue is never held in memory at once (by storage that isn't in memory)
+	EachTitle(ctx context.Context, fn func(t *title.Title) error) error
 }
 
 // Config encapsulates config.StorageConfig, so that we can define methods on it in this package
@@ -74,3 +152,93 @@ func (c *Config) ProcessStorageConfig(storageConfig interface{}) error {
 	prefix := fmt.Sprintf("%s_%s", config.AppName, strings.ToUpper(c.StorageKind))
 	return envconfig.Process(prefix, storageConfig)
 }
+
+// maskPassword masks the basic auth password in a connection URI (if exists)
+func maskPassword(uri string) string {
+	basicAuthPattern := regexp.MustCompile(`(:\/\/[^\/]+:)[^\/]+(@)`)
+	return basicAuthPattern.ReplaceAllString(uri, `$1*****$2`)
+}
+
+// applyPatch applies the merge patch to the title, making sure that the id is unchanged
+// the revision is left as it was, for storage to increment
+func applyPatch(t *title.Title, patch []byte) (*title.Title, error) {
+	patched, err := title.MergePatch(t, patch)
+	if err != nil {
+		return nil, err
+	}
+	if patched.ID != t.ID {
+		return nil, fmt.Errorf("merge patch must not change the title id")
+	}
+	patched.Revision = t.Revision
+	return patched, nil
+}
+
+// checkRevision returns ErrConflict if revision isn't AnyRevision and doesn't match the title's revision
+func checkRevision(t *title.Title, revision int) error {
+	if revision != AnyRevision && t.Revision != revision {
+		return fmt.Errorf("%w since revision %d (now at revision %d) with id: '%s'", ErrConflict, revision, t.Revision, t.ID)
+	}
+	return nil
+}
+
+// withRevision returns a copy of the title at the given revision
+func withRevision(t *title.Title, revision int) *title.Title {
+	revised := *t
+	revised.Revision = revision
+	return &revised
+}
+
+// Validate checks the options are supported by every storage
+func (opts ListOptions) Validate() error {
+	if opts.After != "" && len(opts.Sort) > 0 {
+		return fmt.Errorf("a cursor can only be used with the default order")
+	}
+	seen := map[string]bool{}
+	for _, f := range opts.Sort {
+		if seen[f.Field] {
+			return fmt.Errorf("sort field repeated: '%s'", f.Field)
+		}
+		seen[f.Field] = true
+		if f.Field != "id" && f.Field != "name" && f.Field != "year" && scoreKind(f.Field) == "" {
+			return fmt.Errorf("unsupported sort field: '%s'", f.Field)
+		}
+	}
+	return nil
+}
+
+// scoreKind gets the kind from a "scores.<kind>" field, or "" if it isn't a score field
+func scoreKind(field string) string {
+	if !strings.HasPrefix(field, "scores.") {
+		return ""
+	}
+	return strings.TrimPrefix(field, "scores.")
+}
+
+// bulkResults works out the result of writing each title with BulkUpsert, where existing gets a title already in storage
+// titles earlier in the batch count as existing for any later ones with the same id
+func bulkResults(titles []*title.Title, mode BulkMode, existing func(id string) *title.Title) []BulkResult {
+	written := map[string]*title.Title{}
+	results := make([]BulkResult, len(titles))
+
+	for i, t := range titles {
+		previous, ok := written[t.ID]
+		if !ok {
+			previous = existing(t.ID)
+		}
+
+		switch {
+		case previous == nil:
+			results[i] = BulkResult{Title: withRevision(t, 1), Created: true}
+		case mode == InsertOnly:
+			results[i] = BulkResult{Err: fmt.Errorf("%w with id: '%s'", ErrAlreadyExists, t.ID)}
+		default:
+			results[i] = BulkResult{Title: withRevision(t, previous.Revision+1)}
+		}
+
+		if results[i].Title != nil {
+			written[t.ID] = results[i].Title
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,48 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+// setenv sets an environment variable until the test finishes (t.Setenv needs go 1.17)
+func setenv(t *testing.T, key string, value string) {
+	t.Helper()
+
+	previous, existed := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("failed to set %s: %s", key, err)
+	}
+	t.Cleanup(func() {
+		if existed {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// deleteAllTitles empties storage which is shared between tests
+func deleteAllTitles(t *testing.T, s storage.Storage) {
+	t.Helper()
+
+	ctx := context.Background()
+	ids := []string{}
+	err := s.EachTitle(ctx, func(t *title.Title) error {
+		ids = append(ids, t.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EachTitle() error: %s", err)
+	}
+
+	for _, id := range ids {
+		if err := s.DeleteTitle(ctx, id); err != nil {
+			t.Fatalf("DeleteTitle(%s) error: %s", id, err)
+		}
+	}
+}
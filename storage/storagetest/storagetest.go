@@ -0,0 +1,865 @@
+// Package storagetest is a conformance suite which every storage.Storage implementation should pass
+// so that the api behaves the same, whichever StorageKind is configured
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/microhod/randflix-api/model/title"
+	"github.com/microhod/randflix-api/storage"
+)
+
+// Factory creates a new, empty storage for a single test
+// it should call t.Skip if the storage is not available e.g. there is no database to connect to
+type Factory func(t *testing.T) storage.Storage
+
+type testCase struct {
+	name string
+	test func(t *testing.T, s storage.Storage)
+}
+
+// Run runs the conformance suite against storage created by the factory
+func Run(t *testing.T, factory Factory) {
+	tests := []testCase{
+		{"AddAndGetTitle", testAddAndGetTitle},
+		{"AddDuplicateTitle", testAddDuplicateTitle},
+		{"GetMissingTitle", testGetMissingTitle},
+		{"UpdateTitle", testUpdateTitle},
+		{"UpdateMissingTitle", testUpdateMissingTitle},
+		{"PatchTitle", testPatchTitle},
+		{"PatchMissingTitle", testPatchMissingTitle},
+		{"WriteStaleRevision", testWriteStaleRevision},
+		{"BulkUpsert", testBulkUpsert},
+		{"BulkInsertOnly", testBulkInsertOnly},
+		{"DeleteTitle", testDeleteTitle},
+		{"DeleteMissingTitle", testDeleteMissingTitle},
+		{"ListTitles", testListTitles},
+		{"ListTitlesAfter", testListTitlesAfter},
+		{"ListTitlesSorted", testListTitlesSorted},
+		{"EachTitle", testEachTitle},
+		{"SearchTitles", testSearchTitles},
+		{"Facets", testFacets},
+		{"RandomTitleNoMatch", testRandomTitleNoMatch},
+		{"RandomTitlesDistinct", testRandomTitlesDistinct},
+		{"SampleTitlesWeighted", testSampleTitlesWeighted},
+		{"SampleTitlesWeightBias", testSampleTitlesWeightBias},
+		{"SampleTitlesSeeded", testSampleTitlesSeeded},
+		{"CancelledContext", testCancelledContext},
+	}
+	for _, fc := range filterCases {
+		fc := fc
+		tests = append(tests, testCase{
+			name: fmt.Sprintf("RandomTitleFilters/%s", fc.name),
+			test: func(t *testing.T, s storage.Storage) { testRandomTitleFilter(t, s, fc) },
+		})
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := factory(t)
+			defer s.Disconnect()
+
+			tc.test(t, s)
+		})
+	}
+}
+
+// fixtures are the titles used by the RandomTitle (and CountTitles) filter tests
+func fixtures() []*title.Title {
+	return []*title.Title{
+		{
+			ID:       "comedy-netflix",
+			Name:     "A Comedy",
+			Year:     1995,
+			Genres:   []string{"Comedy"},
+			Scores:   map[string]int{"metascore": 60, "imdb": 7},
+			Services: map[string]*title.Service{"netflix": service("1")},
+		},
+		{
+			ID:       "horror-comedy-prime",
+			Name:     "A Horror Comedy",
+			Year:     2005,
+			Genres:   []string{"Horror", "comedy"},
+			Scores:   map[string]int{"metascore": 40},
+			Services: map[string]*title.Service{"prime": service("2")},
+		},
+		{
+			ID:       "animation-netflix-prime",
+			Name:     "An Animation",
+			Year:     2015,
+			Genres:   []string{"Animation"},
+			Scores:   map[string]int{"metascore": 80, "imdb": 9},
+			Services: map[string]*title.Service{"netflix": service("3"), "prime": service("4")},
+		},
+		{
+			ID:     "drama",
+			Name:   "A Drama",
+			Year:   2020,
+			Genres: []string{"Drama"},
+			Scores: map[string]int{"metascore": 90},
+		},
+	}
+}
+
+func service(id string) *title.Service {
+	return &title.Service{ID: id, URL: fmt.Sprintf("https://example.com/%s", id)}
+}
+
+type filterCase struct {
+	name    string
+	filters []title.Filter
+	want    []string
+}
+
+var filterCases = []filterCase{
+	{"None", nil, []string{"comedy-netflix", "horror-comedy-prime", "animation-netflix-prime", "drama"}},
+	{"EmptyFilters", []title.Filter{
+		title.OnServiceFilter{},
+		title.IsGenreFilter{},
+		title.ExcludeGenresFilter{},
+		title.ScoreBetweenFilter{},
+		title.YearBetweenFilter{},
+		title.ExcludeIDsFilter{},
+		title.AndFilter{},
+		title.OrFilter{},
+	}, []string{"comedy-netflix", "horror-comedy-prime", "animation-netflix-prime", "drama"}},
+	{"OnService", []title.Filter{title.OnServiceFilter{Services: []string{"netflix"}}},
+		[]string{"comedy-netflix", "animation-netflix-prime"}},
+	{"OnAnyService", []title.Filter{title.OnServiceFilter{Services: []string{"prime", "disney"}}},
+		[]string{"horror-comedy-prime", "animation-netflix-prime"}},
+	{"IsGenreCaseInsensitive", []title.Filter{title.IsGenreFilter{Genres: []string{"COMEDY"}}},
+		[]string{"comedy-netflix", "horror-comedy-prime"}},
+	{"IsAllGenres", []title.Filter{title.IsGenreFilter{Genres: []string{"comedy", "horror"}}},
+		[]string{"horror-comedy-prime"}},
+	{"ExcludeGenres", []title.Filter{title.ExcludeGenresFilter{Genres: []string{"horror", "DRAMA"}}},
+		[]string{"comedy-netflix", "animation-netflix-prime"}},
+	{"ScoreBetween", []title.Filter{title.ScoreBetweenFilter{Kind: "metascore", Min: 50, Max: 85}},
+		[]string{"comedy-netflix", "animation-netflix-prime"}},
+	{"ScoreWithoutMax", []title.Filter{title.ScoreBetweenFilter{Kind: "metascore", Min: 80}},
+		[]string{"animation-netflix-prime", "drama"}},
+	{"ScoreKindMissing", []title.Filter{title.ScoreBetweenFilter{Kind: "imdb"}},
+		[]string{"comedy-netflix", "animation-netflix-prime"}},
+	{"YearBetween", []title.Filter{title.YearBetweenFilter{Min: 2000, Max: 2015}},
+		[]string{"horror-comedy-prime", "animation-netflix-prime"}},
+	{"YearWithoutMax", []title.Filter{title.YearBetweenFilter{Min: 2010}},
+		[]string{"animation-netflix-prime", "drama"}},
+	{"ExcludeIDs", []title.Filter{title.ExcludeIDsFilter{IDs: []string{"drama", "comedy-netflix"}}},
+		[]string{"horror-comedy-prime", "animation-netflix-prime"}},
+	{"Combined", []title.Filter{
+		title.OnServiceFilter{Services: []string{"netflix"}},
+		title.ScoreBetweenFilter{Kind: "metascore", Min: 70},
+	}, []string{"animation-netflix-prime"}},
+	{"Expression", []title.Filter{title.AndFilter{Filters: []title.Filter{
+		title.OrFilter{Filters: []title.Filter{
+			title.IsGenreFilter{Genres: []string{"comedy"}},
+			title.IsGenreFilter{Genres: []string{"animation"}},
+		}},
+		title.NotFilter{Filter: title.IsGenreFilter{Genres: []string{"horror"}}},
+	}}}, []string{"comedy-netflix", "animation-netflix-prime"}},
+	{"NotEmptyFilter", []title.Filter{title.NotFilter{Filter: title.IsGenreFilter{}}}, []string{}},
+	{"NoMatch", []title.Filter{title.IsGenreFilter{Genres: []string{"western"}}}, []string{}},
+}
+
+func testAddAndGetTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	want := fixtures()[0]
+
+	if _, err := s.AddTitle(ctx, want); err != nil {
+		t.Fatalf("AddTitle() error: %s", err)
+	}
+	want.Revision = 1
+
+	got, err := s.GetTitle(ctx, want.ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTitle() = %+v, want %+v", got, want)
+	}
+}
+
+func testAddDuplicateTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	original := fixtures()[0]
+	addTitles(t, s, original)
+
+	duplicate := fixtures()[0]
+	duplicate.Name = "A Duplicate"
+	if _, err := s.AddTitle(ctx, duplicate); !errors.Is(err, storage.ErrAlreadyExists) {
+		t.Errorf("AddTitle() with a duplicate id returned error '%v', want ErrAlreadyExists", err)
+	}
+
+	got, err := s.GetTitle(ctx, original.ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if got == nil || got.Name != original.Name {
+		t.Errorf("GetTitle() = %+v, want the original title to be unchanged", got)
+	}
+}
+
+func testGetMissingTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	got, err := s.GetTitle(ctx, "missing")
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if got != nil {
+		t.Errorf("GetTitle() = %+v, want nil", got)
+	}
+}
+
+func testUpdateTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()[0])
+
+	want := fixtures()[0]
+	want.Name = "An Updated Comedy"
+	want.Scores["metascore"] = 99
+
+	if _, err := s.UpdateTitle(ctx, want, storage.AnyRevision); err != nil {
+		t.Fatalf("UpdateTitle() error: %s", err)
+	}
+	want.Revision = 2
+
+	got, err := s.GetTitle(ctx, want.ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTitle() = %+v, want %+v", got, want)
+	}
+}
+
+func testUpdateMissingTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	missing := fixtures()[0]
+
+	if _, err := s.UpdateTitle(ctx, missing, storage.AnyRevision); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("UpdateTitle() with a missing id returned error '%v', want ErrNotFound", err)
+	}
+
+	got, err := s.GetTitle(ctx, missing.ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if got != nil {
+		t.Errorf("GetTitle() = %+v, want nil (UpdateTitle should not create titles)", got)
+	}
+}
+
+func testPatchTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()[0], fixtures()[3])
+
+	patch := []byte(`{"name": "A Patched Comedy", "scores": {"imdb": null, "metascore": 75}, "services": {"prime": {"id": "5"}}}`)
+	want := fixtures()[0]
+	want.Name = "A Patched Comedy"
+	want.Scores = map[string]int{"metascore": 75}
+	want.Services["prime"] = &title.Service{ID: "5"}
+	want.Revision = 2
+
+	got, err := s.PatchTitle(ctx, want.ID, patch, storage.AnyRevision)
+	if err != nil {
+		t.Fatalf("PatchTitle() error: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PatchTitle() = %+v, want %+v", got, want)
+	}
+
+	got, err = s.GetTitle(ctx, want.ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTitle() = %+v, want %+v", got, want)
+	}
+
+	// patching a map which isn't set yet
+	want = fixtures()[3]
+	want.Services = map[string]*title.Service{"netflix": service("6")}
+	want.Revision = 2
+
+	got, err = s.PatchTitle(ctx, want.ID, []byte(`{"services": {"netflix": {"id": "6", "url": "https://example.com/6"}}}`), 1)
+	if err != nil {
+		t.Fatalf("PatchTitle() error: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PatchTitle() = %+v, want %+v", got, want)
+	}
+}
+
+func testPatchMissingTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	_, err := s.PatchTitle(ctx, "missing", []byte(`{"name": "Missing"}`), storage.AnyRevision)
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("PatchTitle() error = %v, want %v", err, storage.ErrNotFound)
+	}
+}
+
+func testWriteStaleRevision(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()[0])
+
+	updated := fixtures()[0]
+	updated.Name = "An Updated Comedy"
+	if _, err := s.UpdateTitle(ctx, updated, 1); err != nil {
+		t.Fatalf("UpdateTitle() at the current revision error: %s", err)
+	}
+
+	stale := fixtures()[0]
+	stale.Name = "A Stale Comedy"
+	if _, err := s.UpdateTitle(ctx, stale, 1); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("UpdateTitle() at a stale revision returned error '%v', want ErrConflict", err)
+	}
+	if _, err := s.PatchTitle(ctx, stale.ID, []byte(`{"name": "A Stale Comedy"}`), 1); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("PatchTitle() at a stale revision returned error '%v', want ErrConflict", err)
+	}
+
+	got, err := s.GetTitle(ctx, updated.ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if got == nil || got.Name != updated.Name || got.Revision != 2 {
+		t.Errorf("GetTitle() = %+v, want the updated title at revision 2", got)
+	}
+}
+
+func testBulkUpsert(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()[0])
+
+	updated := fixtures()[0]
+	updated.Name = "An Updated Comedy"
+
+	results, err := s.BulkUpsert(ctx, []*title.Title{updated, fixtures()[1]}, storage.Upsert)
+	if err != nil {
+		t.Fatalf("BulkUpsert() error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("BulkUpsert() returned %d results, want 2", len(results))
+	}
+	for i, want := range []struct {
+		created  bool
+		revision int
+	}{{false, 2}, {true, 1}} {
+		r := results[i]
+		if r.Err != nil || r.Created != want.created || r.Title == nil || r.Title.Revision != want.revision {
+			t.Errorf("BulkUpsert() result %d = %+v, want created %t at revision %d", i, r, want.created, want.revision)
+		}
+	}
+
+	got, err := s.GetTitle(ctx, updated.ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if got == nil || got.Name != updated.Name {
+		t.Errorf("GetTitle() = %+v, want the updated title", got)
+	}
+	if got, _ := s.GetTitle(ctx, fixtures()[1].ID); got == nil {
+		t.Errorf("GetTitle() = nil, want the created title")
+	}
+}
+
+func testBulkInsertOnly(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()[0])
+
+	duplicate := fixtures()[0]
+	duplicate.Name = "A Duplicate"
+
+	results, err := s.BulkUpsert(ctx, []*title.Title{duplicate, fixtures()[1]}, storage.InsertOnly)
+	if err != nil {
+		t.Fatalf("BulkUpsert() error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("BulkUpsert() returned %d results, want 2", len(results))
+	}
+	if !errors.Is(results[0].Err, storage.ErrAlreadyExists) {
+		t.Errorf("BulkUpsert() with a duplicate id returned error '%v', want ErrAlreadyExists", results[0].Err)
+	}
+	if results[1].Err != nil || !results[1].Created {
+		t.Errorf("BulkUpsert() result 1 = %+v, want created", results[1])
+	}
+
+	got, err := s.GetTitle(ctx, duplicate.ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if got == nil || got.Name != fixtures()[0].Name {
+		t.Errorf("GetTitle() = %+v, want the original title to be unchanged", got)
+	}
+}
+
+func testDeleteTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	titles := fixtures()
+	addTitles(t, s, titles...)
+
+	if err := s.DeleteTitle(ctx, titles[0].ID); err != nil {
+		t.Fatalf("DeleteTitle() error: %s", err)
+	}
+
+	got, err := s.GetTitle(ctx, titles[0].ID)
+	if err != nil {
+		t.Fatalf("GetTitle() error: %s", err)
+	}
+	if got != nil {
+		t.Errorf("GetTitle() = %+v, want nil after delete", got)
+	}
+	if got, _ := s.GetTitle(ctx, titles[1].ID); got == nil {
+		t.Errorf("GetTitle(%s) = nil, DeleteTitle() should only delete a single title", titles[1].ID)
+	}
+}
+
+func testDeleteMissingTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	if err := s.DeleteTitle(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("DeleteTitle() with a missing id returned error '%v', want ErrNotFound", err)
+	}
+}
+
+func testListTitles(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for _, id := range []string{"c", "a", "e", "b", "d"} {
+		addTitles(t, s, &title.Title{ID: id})
+	}
+
+	// titles are ordered by 'highest' ID first, and pages are zero indexed
+	pages := [][]string{{"e", "d"}, {"c", "b"}, {"a"}, {}}
+	for page, want := range pages {
+		got, err := s.ListTitles(ctx, storage.ListOptions{PageSize: 2, Page: page})
+		if err != nil {
+			t.Fatalf("ListTitles(2, %d) error: %s", page, err)
+		}
+		if !reflect.DeepEqual(ids(got.Titles), want) {
+			t.Errorf("ListTitles(2, %d) = %v, want %v", page, ids(got.Titles), want)
+		}
+		if got.Total != 5 {
+			t.Errorf("ListTitles(2, %d) total = %d, want 5", page, got.Total)
+		}
+	}
+}
+
+func testListTitlesAfter(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for _, id := range []string{"c", "a", "e", "b", "d"} {
+		addTitles(t, s, &title.Title{ID: id})
+	}
+
+	// the cursor doesn't need to be an existing title, and page is ignored
+	cursors := []struct {
+		after string
+		want  []string
+	}{{"e", []string{"d", "c"}}, {"cc", []string{"c", "b"}}, {"b", []string{"a"}}, {"a", []string{}}}
+	for _, c := range cursors {
+		got, err := s.ListTitles(ctx, storage.ListOptions{PageSize: 2, Page: 3, After: c.after})
+		if err != nil {
+			t.Fatalf("ListTitles(after %s) error: %s", c.after, err)
+		}
+		if !reflect.DeepEqual(ids(got.Titles), c.want) {
+			t.Errorf("ListTitles(after %s) = %v, want %v", c.after, ids(got.Titles), c.want)
+		}
+		if got.Total != 5 {
+			t.Errorf("ListTitles(after %s) total = %d, want 5", c.after, got.Total)
+		}
+	}
+}
+
+func testListTitlesSorted(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()...)
+
+	cases := []struct {
+		name    string
+		filters []title.Filter
+		sort    []storage.SortField
+		want    []string
+	}{
+		{"YearDescending", nil, []storage.SortField{{Field: "year", Descending: true}},
+			[]string{"drama", "animation-netflix-prime", "horror-comedy-prime", "comedy-netflix"}},
+		{"Name", nil, []storage.SortField{{Field: "name"}},
+			[]string{"comedy-netflix", "drama", "horror-comedy-prime", "animation-netflix-prime"}},
+		// titles without the score sort first, then by 'highest' ID first
+		{"Score", nil, []storage.SortField{{Field: "scores.imdb"}},
+			[]string{"horror-comedy-prime", "drama", "comedy-netflix", "animation-netflix-prime"}},
+		{"ScoreDescending", nil, []storage.SortField{{Field: "scores.imdb", Descending: true}},
+			[]string{"animation-netflix-prime", "comedy-netflix", "horror-comedy-prime", "drama"}},
+		{"Filtered", []title.Filter{title.OnServiceFilter{Services: []string{"prime"}}}, []storage.SortField{{Field: "year"}},
+			[]string{"horror-comedy-prime", "animation-netflix-prime"}},
+	}
+
+	for _, c := range cases {
+		got, err := s.ListTitles(ctx, storage.ListOptions{PageSize: 10, Filters: c.filters, Sort: c.sort})
+		if err != nil {
+			t.Fatalf("ListTitles(%s) error: %s", c.name, err)
+		}
+		if !reflect.DeepEqual(ids(got.Titles), c.want) {
+			t.Errorf("ListTitles(%s) = %v, want %v", c.name, ids(got.Titles), c.want)
+		}
+		if got.Total != len(c.want) {
+			t.Errorf("ListTitles(%s) total = %d, want %d", c.name, got.Total, len(c.want))
+		}
+	}
+}
+
+func testEachTitle(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for _, id := range []string{"c", "a", "e", "b", "d"} {
+		addTitles(t, s, &title.Title{ID: id})
+	}
+
+	got := []string{}
+	err := s.EachTitle(ctx, func(t *title.Title) error {
+		got = append(got, t.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EachTitle() error: %s", err)
+	}
+	if want := []string{"e", "d", "c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EachTitle() = %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = s.EachTitle(ctx, func(t *title.Title) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("EachTitle() returned error '%v' after %d calls, want the error from fn after 1 call", err, calls)
+	}
+}
+
+func testSearchTitles(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s,
+		&title.Title{ID: "space-name", Name: "Space Station", Description: "A crew far from home"},
+		&title.Title{ID: "space-description", Name: "The Crew", Description: "Lost in space"},
+		&title.Title{ID: "spaceship", Name: "Spaceship Troopers", Description: "Bugs"},
+	)
+
+	search := func(query string, limit int, want ...string) {
+		t.Helper()
+		titles, err := s.SearchTitles(ctx, query, limit)
+		if err != nil {
+			t.Fatalf("SearchTitles(%q) error: %s", query, err)
+		}
+		got := ids(titles)
+		if len(want) == 0 {
+			want = []string{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SearchTitles(%q, %d) = %v, want %v", query, limit, got, want)
+		}
+	}
+
+	// whole words in the name rank above prefixes, which rank above whole words in the description
+	search("space", 10, "space-name", "spaceship", "space-description")
+	search("SPACE", 1, "space-name")
+	search("crew", 10, "space-description", "space-name")
+	// only the last word can match as a prefix
+	search("spa station", 10)
+	search("space sta", 10, "space-name")
+	search("western", 10)
+
+	update := &title.Title{ID: "space-description", Name: "The Crew", Description: "Lost at sea"}
+	if _, err := s.UpdateTitle(ctx, update, storage.AnyRevision); err != nil {
+		t.Fatalf("UpdateTitle() error: %s", err)
+	}
+	search("space", 10, "space-name", "spaceship")
+	search("sea", 10, "space-description")
+
+	if err := s.DeleteTitle(ctx, "space-name"); err != nil {
+		t.Fatalf("DeleteTitle() error: %s", err)
+	}
+	search("space", 10, "spaceship")
+}
+
+func testFacets(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()...)
+	addTitles(t, s, &title.Title{ID: "unknown"})
+
+	facets := func(name string, want *storage.Facets, filters ...title.Filter) {
+		t.Helper()
+		got, err := s.Facets(ctx, filters...)
+		if err != nil {
+			t.Fatalf("Facets() %s error: %s", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Facets() %s = %+v, want %+v", name, got, want)
+		}
+	}
+
+	all := &storage.Facets{
+		Total:      5,
+		Genres:     []storage.FacetCount{{Value: "comedy", Count: 2}, {Value: "animation", Count: 1}, {Value: "drama", Count: 1}, {Value: "horror", Count: 1}},
+		Services:   []storage.FacetCount{{Value: "netflix", Count: 2}, {Value: "prime", Count: 2}},
+		ScoreKinds: []storage.FacetCount{{Value: "metascore", Count: 4}, {Value: "imdb", Count: 2}},
+		Years:      storage.YearRange{Min: 1995, Max: 2020, Count: 4},
+	}
+	facets("without filters", all)
+	facets("with filters which have no effect", all, title.IsGenreFilter{}, title.ScoreBetweenFilter{}, title.YearBetweenFilter{})
+
+	facets("on netflix", &storage.Facets{
+		Total:      2,
+		Genres:     []storage.FacetCount{{Value: "animation", Count: 1}, {Value: "comedy", Count: 1}},
+		Services:   []storage.FacetCount{{Value: "netflix", Count: 2}, {Value: "prime", Count: 1}},
+		ScoreKinds: []storage.FacetCount{{Value: "imdb", Count: 2}, {Value: "metascore", Count: 2}},
+		Years:      storage.YearRange{Min: 1995, Max: 2015, Count: 2},
+	}, title.OnServiceFilter{Services: []string{"netflix"}})
+
+	facets("without a match", &storage.Facets{
+		Genres:     []storage.FacetCount{},
+		Services:   []storage.FacetCount{},
+		ScoreKinds: []storage.FacetCount{},
+	}, title.IsGenreFilter{Genres: []string{"western"}})
+
+	update := &title.Title{ID: "comedy-netflix", Year: 1990, Genres: []string{"Comedy", "Romance"}}
+	if _, err := s.UpdateTitle(ctx, update, storage.AnyRevision); err != nil {
+		t.Fatalf("UpdateTitle() error: %s", err)
+	}
+	if err := s.DeleteTitle(ctx, "drama"); err != nil {
+		t.Fatalf("DeleteTitle() error: %s", err)
+	}
+	facets("after update and delete", &storage.Facets{
+		Total:      4,
+		Genres:     []storage.FacetCount{{Value: "comedy", Count: 2}, {Value: "animation", Count: 1}, {Value: "horror", Count: 1}, {Value: "romance", Count: 1}},
+		Services:   []storage.FacetCount{{Value: "prime", Count: 2}, {Value: "netflix", Count: 1}},
+		ScoreKinds: []storage.FacetCount{{Value: "metascore", Count: 2}, {Value: "imdb", Count: 1}},
+		Years:      storage.YearRange{Min: 1990, Max: 2015, Count: 3},
+	})
+}
+
+func testRandomTitleNoMatch(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()...)
+
+	got, err := s.RandomTitle(ctx, title.IsGenreFilter{Genres: []string{"western"}})
+	if err != nil {
+		t.Fatalf("RandomTitle() error: %s", err)
+	}
+	if got != nil {
+		t.Errorf("RandomTitle() = %+v, want nil", got)
+	}
+}
+
+func testRandomTitlesDistinct(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	titles := fixtures()
+	addTitles(t, s, titles...)
+
+	for count := 1; count <= len(titles)+1; count++ {
+		got, err := s.RandomTitles(ctx, count)
+		if err != nil {
+			t.Fatalf("RandomTitles(%d) error: %s", count, err)
+		}
+
+		want := count
+		if want > len(titles) {
+			want = len(titles)
+		}
+		if len(got) != want {
+			t.Errorf("RandomTitles(%d) returned %d titles, want %d", count, len(got), want)
+		}
+
+		seen := map[string]bool{}
+		for _, id := range ids(got) {
+			if seen[id] {
+				t.Errorf("RandomTitles(%d) returned '%s' more than once", count, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func testSampleTitlesWeighted(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()...)
+	addTitles(t, s, &title.Title{ID: "zero", Scores: map[string]int{"imdb": 0}})
+
+	sample := func(weight storage.Weight, filters ...title.Filter) []string {
+		t.Helper()
+		titles, err := s.SampleTitles(ctx, storage.SampleOptions{Count: 10, Weight: weight, Filters: filters})
+		if err != nil {
+			t.Fatalf("SampleTitles() by %+v error: %s", weight, err)
+		}
+		got := ids(titles)
+		sort.Strings(got)
+		return got
+	}
+
+	// titles without the score, or with a score of 0, are never chosen
+	if got, want := sample(storage.Weight{Kind: storage.ScoreWeight, ScoreKind: "imdb"}), []string{"animation-netflix-prime", "comedy-netflix"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SampleTitles() by imdb score = %v, want %v", got, want)
+	}
+	if got, want := sample(storage.Weight{Kind: storage.RecencyWeight}, title.OnServiceFilter{Services: []string{"prime"}}), []string{"animation-netflix-prime", "horror-comedy-prime"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SampleTitles() by recency on prime = %v, want %v", got, want)
+	}
+	if got := sample(storage.Weight{Kind: storage.Uniform}); len(got) != 5 {
+		t.Errorf("SampleTitles() uniformly = %v, want all 5 titles", got)
+	}
+
+	if _, err := s.SampleTitles(ctx, storage.SampleOptions{Count: 1, Weight: storage.Weight{Kind: storage.ScoreWeight}}); err == nil {
+		t.Errorf("SampleTitles() by score without a score kind, want error")
+	}
+}
+
+func testSampleTitlesWeightBias(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	year := time.Now().Year()
+	addTitles(t, s,
+		&title.Title{ID: "classic", Year: year, Scores: map[string]int{"metascore": 99}},
+		&title.Title{ID: "obscure", Year: year - 50, Scores: map[string]int{"metascore": 1}},
+	)
+
+	// the obscure title has 1/100 of the weight by score and 1/32 by recency, so should rarely be chosen
+	for _, weight := range []storage.Weight{
+		{Kind: storage.ScoreWeight, ScoreKind: "metascore"},
+		{Kind: storage.RecencyWeight},
+	} {
+		chosen := map[string]int{}
+		for i := 0; i < 200; i++ {
+			titles, err := s.SampleTitles(ctx, storage.SampleOptions{Count: 1, Weight: weight})
+			if err != nil {
+				t.Fatalf("SampleTitles() by %+v error: %s", weight, err)
+			}
+			if len(titles) != 1 {
+				t.Fatalf("SampleTitles() by %+v returned %d titles, want 1", weight, len(titles))
+			}
+			chosen[titles[0].ID]++
+		}
+		if chosen["classic"] < 150 {
+			t.Errorf("SampleTitles() by %+v chose %v, want the classic title far more often", weight, chosen)
+		}
+	}
+}
+
+func testSampleTitlesSeeded(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	addTitles(t, s, fixtures()...)
+
+	sample := func(seed string, weight storage.Weight) []string {
+		t.Helper()
+		titles, err := s.SampleTitles(ctx, storage.SampleOptions{Count: 3, Weight: weight, Seed: seed})
+		if err != nil {
+			t.Fatalf("SampleTitles() with seed %q error: %s", seed, err)
+		}
+		return ids(titles)
+	}
+
+	// the titles chosen for a seed are the same for all storage, in the same order
+	for _, tc := range []struct {
+		weight storage.Weight
+		want   []string
+	}{
+		{storage.Weight{}, []string{"drama", "animation-netflix-prime", "horror-comedy-prime"}},
+		{storage.Weight{Kind: storage.ScoreWeight, ScoreKind: "metascore"}, []string{"drama", "animation-netflix-prime", "comedy-netflix"}},
+	} {
+		for i := 0; i < 3; i++ {
+			if got := sample("randflix", tc.weight); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("SampleTitles() by %+v with seed 'randflix' = %v, want %v", tc.weight, got, tc.want)
+			}
+		}
+	}
+
+	// different seeds choose different titles
+	chosen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		chosen[sample(fmt.Sprintf("seed-%d", i), storage.Weight{})[0]] = true
+	}
+	if len(chosen) < 2 {
+		t.Errorf("SampleTitles() with 20 different seeds always chose %v first", chosen)
+	}
+}
+
+func testCancelledContext(t *testing.T, s storage.Storage) {
+	addTitles(t, s, fixtures()...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.RandomTitles(ctx, 1); err == nil {
+		t.Errorf("RandomTitles() with a cancelled context returned no error")
+	}
+	if _, err := s.ListTitles(ctx, storage.ListOptions{PageSize: 10}); err == nil {
+		t.Errorf("ListTitles() with a cancelled context returned no error")
+	}
+}
+
+func testRandomTitleFilter(t *testing.T, s storage.Storage, fc filterCase) {
+	ctx := context.Background()
+	titles := fixtures()
+	addTitles(t, s, titles...)
+
+	got, err := s.RandomTitles(ctx, len(titles)+1, fc.filters...)
+	if err != nil {
+		t.Fatalf("RandomTitles() error: %s", err)
+	}
+
+	want := append([]string{}, fc.want...)
+	sort.Strings(want)
+	gotIDs := ids(got)
+	sort.Strings(gotIDs)
+
+	if !reflect.DeepEqual(gotIDs, want) {
+		t.Errorf("RandomTitles() matched %v, want %v", gotIDs, want)
+	}
+
+	single, err := s.RandomTitle(ctx, fc.filters...)
+	if err != nil {
+		t.Fatalf("RandomTitle() error: %s", err)
+	}
+	if len(want) == 0 && single != nil {
+		t.Errorf("RandomTitle() = %s, want nil", single.ID)
+	}
+	if len(want) > 0 && (single == nil || !contains(want, single.ID)) {
+		t.Errorf("RandomTitle() = %+v, want one of %v", single, want)
+	}
+
+	count, err := s.CountTitles(ctx, fc.filters...)
+	if err != nil {
+		t.Fatalf("CountTitles() error: %s", err)
+	}
+	if count != len(want) {
+		t.Errorf("CountTitles() = %d, want %d", count, len(want))
+	}
+}
+
+func addTitles(t *testing.T, s storage.Storage, titles ...*title.Title) {
+	t.Helper()
+
+	ctx := context.Background()
+	for _, tt := range titles {
+		if _, err := s.AddTitle(ctx, tt); err != nil {
+			t.Fatalf("AddTitle(%s) error: %s", tt.ID, err)
+		}
+	}
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func ids(titles []*title.Title) []string {
+	result := []string{}
+	for _, t := range titles {
+		result = append(result, t.ID)
+	}
+	return result
+}